@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// With --rewrite-older-than, files last written longer ago than this are rewritten
+// no matter how well they are compressed, 0 turns it off
+var rewriteolderthan *time.Duration
+
+// lastwritten is when the data of the file was last written, by whoever wrote it or by
+// us recompressing it. recompressed comes from the resume database, 0 if not known.
+func lastwritten(fileinfo os.FileInfo, recompressed int64) time.Time {
+	written := fileinfo.ModTime()
+	if recompressed != 0 && time.Unix(0, recompressed).After(written) {
+		written = time.Unix(0, recompressed)
+	}
+	return written
+}
+
+// stale tells if the file is due for a rewrite by --rewrite-older-than
+func stale(fileinfo os.FileInfo, recompressed int64) bool {
+	return *rewriteolderthan > 0 && time.Since(lastwritten(fileinfo, recompressed)) > *rewriteolderthan
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// expectedratio returns the compression ratio a ZFS compression algorithm
+// typically reaches on mixed, compressible data. Files already compressed
+// that well won't get any better by rewriting them with it.
+func expectedratio(algorithm string) (float64, bool) {
+	algorithm = strings.ToLower(algorithm)
+	switch algorithm {
+	case "zle":
+		return 1.1, true
+	case "lzjb":
+		return 1.3, true
+	case "on", "lz4":
+		return 1.5, true
+	case "gzip":
+		algorithm = "gzip-6"
+	case "zstd":
+		algorithm = "zstd-3"
+	}
+
+	if strings.HasPrefix(algorithm, "zstd-fast") {
+		return 1.4, true
+	}
+	if level, found := strings.CutPrefix(algorithm, "gzip-"); found {
+		switch n, err := strconv.Atoi(level); {
+		case err != nil || n < 1 || n > 9:
+			return 0, false
+		case n <= 3:
+			return 1.8, true
+		case n <= 6:
+			return 2.0, true
+		default:
+			return 2.1, true
+		}
+	}
+	if level, found := strings.CutPrefix(algorithm, "zstd-"); found {
+		switch n, err := strconv.Atoi(level); {
+		case err != nil || n < 1 || n > 19:
+			return 0, false
+		case n <= 3:
+			return 1.9, true
+		case n <= 9:
+			return 2.1, true
+		default:
+			return 2.3, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// How many records of a file --audit-skips compresses, spread over the file
+const auditrecords = 8
+
+// A sample compressing this much better than the file is stored now makes its skip suspect
+const auditmargin = 1.25
+
+var auditedfiles, suspectskips atomic.Uint64
+
+// The compressor for the audits, one per worker goroutine at most
+var auditcompressors sync.Pool
+
+// auditalgorithm picks what --audit-skips compresses with: --target-algorithm if
+// it's one --compare-algorithms knows, lz4 otherwise as that's the ZFS default
+func auditalgorithm(target string) comparealgorithm {
+	switch target {
+	case "gzip":
+		target = "gzip-6"
+	case "zstd":
+		target = "zstd-3"
+	}
+	for _, algorithm := range comparealgorithms {
+		if target != "" && (algorithm.name == target || strings.HasPrefix(algorithm.name, target+" ")) {
+			return algorithm
+		}
+	}
+	return comparealgorithms[0]
+}
+
+var auditwith comparealgorithm
+
+// samplerecords compresses auditrecords records spread over the file, and returns how
+// much was read, how much of that wasn't zeroes and what that would take on disk
+func samplerecords(f *os.File, size int64, buffer []byte, compress compressor) (read, sampled, alloc uint64, err error) {
+	record := buffer[:min(holesize, len(buffer))]
+	for i := int64(0); i < auditrecords; i++ {
+		offset := size * (2*i + 1) / (2 * auditrecords) / holesize * holesize
+		n, err := f.ReadAt(record, offset)
+		if err != nil && err != io.EOF {
+			return 0, 0, 0, err
+		}
+		read += uint64(n)
+		if n == 0 || bytes.Equal(record[:n], zeroes[:n]) {
+			continue
+		}
+		sampled += uint64(n)
+		alloc += allocated(n, compress(record[:n]))
+	}
+	return read, sampled, alloc, nil
+}
+
+// auditskip compresses a few records of a file the ratio check skipped, and
+// reports it if they compress clearly better than the file is stored now.
+// Records of zeroes are left out, so a sparse file with uncompressed data shows up too.
+func auditskip(fp string, size, ondisk int64, buffer []byte) {
+	f, err := opensource(fp)
+	if err != nil {
+		logerror("Could not audit %s: %v", fp, err)
+		return
+	}
+	defer f.Close()
+
+	compress, _ := auditcompressors.Get().(compressor)
+	if compress == nil {
+		compress = auditwith.new()
+	}
+	defer auditcompressors.Put(compress)
+
+	read, sampled, alloc, err := samplerecords(f, size, buffer, compress)
+	if err != nil {
+		logerror("Could not audit %s: %v", fp, err)
+		return
+	}
+	auditedfiles.Add(1)
+	if sampled == 0 {
+		debug("Audit of %s: nothing but zeroes in the sampled records, the skip is fine", fp)
+		return
+	}
+
+	// Holes take no space, so compare with how the data in between is stored,
+	// guessing how much of the file is holes from the samples
+	stored := float64(size) * float64(sampled) / float64(read) / float64(ondisk)
+	sample := float64(sampled) / float64(alloc)
+	if sample > stored*auditmargin {
+		suspectskips.Add(1)
+		log("Suspect skip: the data of %s looks to be stored at %.2f:1, but samples of it compress %.2f:1 with %s", fp, stored, sample, auditwith.name)
+	} else {
+		debug("Audit of %s: stored at %.2f:1, samples compress %.2f:1 with %s, the skip is fine", fp, stored, sample, auditwith.name)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// With --parallelism auto, how long each number of threads is tried
+const autotuneinterval = 20 * time.Second
+
+// How often the number of threads --parallelism auto is at gets logged
+const autotunereport = 5 * time.Minute
+
+// Throughput has to change by more than this to count as better or worse
+const autotunemargin = 0.05
+
+var parallelism *string
+
+// Bytes read by copyrecords, which is what --parallelism auto goes by. Counting as
+// the data goes through instead of per file keeps big files from making it jumpy.
+var copiedbytes atomic.Uint64
+
+// startautotune lets up to --threads workers go, starting with two. It doubles the
+// number while that gets more data through, then moves one at a time: on in the same
+// direction as long as it helps, back when it hurts and down when it makes no
+// difference, as threads that don't add anything only make the disks seek more.
+// Call stop when done.
+func startautotune() (g *workergate, stop func()) {
+	g = newworkergate(min(2, int(*threads)))
+	log("Parallelism: starting with %v threads, tuning between 1 and %v by throughput", g.getlimit(), *threads)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(autotuneinterval)
+		defer ticker.Stop()
+
+		lastbytes := copiedbytes.Load()
+		lastreport := time.Now()
+		var prevrate, bestrate float64
+		var prevlimit, bestlimit int
+		direction, growing := 1, true
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			bytes := copiedbytes.Load()
+			rate := float64(bytes-lastbytes) / autotuneinterval.Seconds()
+			lastbytes = bytes
+			if rate == 0 {
+				// Nothing was copied, skipping files tells nothing about the threads
+				continue
+			}
+
+			limit := g.getlimit()
+			if rate > bestrate {
+				bestrate, bestlimit = rate, limit
+			}
+			next := limit
+			switch {
+			case prevlimit == 0 || rate > prevrate*(1+autotunemargin):
+				if growing {
+					next = limit * 2
+				} else {
+					next = limit + direction
+				}
+			case rate < prevrate*(1-autotunemargin):
+				growing = false
+				next = prevlimit
+				if limit > prevlimit {
+					direction = -1
+				} else {
+					direction = 1
+				}
+			default:
+				growing = false
+				direction = -1
+				next = limit - 1
+			}
+			next = max(1, min(next, int(*threads)))
+			debug("Parallelism: %v threads copied %v/s, going to %v", limit, humanize.IBytes(uint64(rate)), next)
+			prevrate, prevlimit = rate, limit
+			g.setlimit(next)
+
+			if time.Since(lastreport) >= autotunereport {
+				log("Parallelism: running %v threads, the most got through with %v (%v/s)", next, bestlimit, humanize.IBytes(uint64(bestrate)))
+				lastreport = time.Now()
+			}
+		}
+	}()
+	return g, func() {
+		close(done)
+	}
+}
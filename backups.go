@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Signs that a backup tool which notices changed files by their ctime is set up on this host
+var backupsigns = []struct {
+	tool  string
+	paths []string
+}{
+	{"borg", []string{"/etc/borgmatic", "/etc/borgmatic.d", "~/.config/borg", "~/.config/borgmatic"}},
+	{"restic", []string{"/etc/restic", "~/.cache/restic", "~/.config/resticprofile"}},
+	{"Bacula", []string{"/etc/bacula"}},
+	{"Bareos", []string{"/etc/bareos"}},
+	{"Amanda", []string{"/etc/amanda"}},
+}
+
+// backuptools returns the backup tools that look to be in use here
+func backuptools() []string {
+	home, _ := os.UserHomeDir()
+	var tools []string
+	for _, sign := range backupsigns {
+		for _, fp := range sign.paths {
+			if fp[0] == '~' {
+				if home == "" {
+					continue
+				}
+				fp = filepath.Join(home, fp[1:])
+			}
+			if _, err := os.Stat(fp); err == nil {
+				tools = append(tools, sign.tool)
+				break
+			}
+		}
+	}
+	return tools
+}
+
+// warnbackups tells when rewritten files will be seen as changed by the backups
+func warnbackups() {
+	for _, tool := range backuptools() {
+		log("Warning: this host seems to be backed up with %s, which notices changed files by their ctime. The ctime of every rewritten file changes, so they will all be backed up again.", tool)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// command is one of the verbs the tool can be started with. They all share
+// the flag variables, but each only takes the flags that make sense for it.
+type command struct {
+	name        string
+	description string
+	flags       []string // besides commonflags, nil for all but the modeflags
+	mode        map[string]string
+}
+
+// Flags that pick something else to do than a run, the commands for them set them
+var modeflags = []string{"resume-dump", "resume-compact", "resume-export", "resume-import", "compare-algorithms", "explain", "restore-mtimes", "list-ignore-groups"}
+
+// Flags every command takes
+var commonflags = []string{"debug", "print-effective-config", "json", "threads", "buffersize", "max-memory", "queue-size"}
+
+// Flags for picking which files to look at
+var selectflags = []string{"exclude", "exclude-from", "use-ignore-files", "ignore", "ignore-groups", "no-ignore", "minfilesize", "owner", "group",
+	"one-file-system", "sample", "sample-seed", "temp-prefix", "noatime"}
+
+// Flags for where the resume database is
+var resumeflags = []string{"noresume", "resume-db", "resume-memory", "persistent-resume", "resume-unsafe-fast", "output-dir"}
+
+// Flags for deciding what gets rewritten, and how the walk goes
+var checkflags = []string{"skipratio", "skip-minimal", "no-skip-compressed", "zdb-check", "target-algorithm", "force", "checksum-cache",
+	"since-last-run", "exclude-newer-than-snapshot", "rewrite-older-than", "all-datasets", "skip-dedup", "parallel-walk", "walk-order", "strict", "order", "shuffle", "randomize-order",
+	"keep-going", "max-errors", "max-file-count", "mount-check-interval", "mime", "timing", "compression-property-check-interval", "audit-skips"}
+
+func flaglist(groups ...[]string) []string {
+	var flags []string
+	for _, group := range groups {
+		flags = append(flags, group...)
+	}
+	return flags
+}
+
+var commands = []command{
+	{
+		name:        "run",
+		description: "Rewrite the files below the given paths, or the current directory (the default)",
+	},
+	{
+		name:        "list",
+		description: "Show which files would be rewritten, without changing anything (like --dry-run)",
+		flags:       flaglist(selectflags, resumeflags, checkflags, []string{"print0", "csv"}),
+		mode:        map[string]string{"dry-run": "on"},
+	},
+	{
+		name:        "estimate",
+		description: "Compress the files in memory with several algorithms and show the ratios per extension (like --compare-algorithms)",
+		flags:       flaglist(selectflags, []string{"test-block-size"}),
+		mode:        map[string]string{"compare-algorithms": "true"},
+	},
+	{
+		name:        "verify",
+		description: "Read every file back, to check nothing became unreadable",
+		flags:       selectflags,
+	},
+	{
+		name:        "resume-stats",
+		description: "Show what is in the resume database (like --resume-dump)",
+		flags:       flaglist(resumeflags, []string{"mirror-to"}),
+		mode:        map[string]string{"resume-dump": "true"},
+	},
+	{
+		name:        "resume-compact",
+		description: "Compact the resume database to reclaim space (like --resume-compact)",
+		flags:       flaglist(resumeflags, []string{"mirror-to"}),
+		mode:        map[string]string{"resume-compact": "true"},
+	},
+}
+
+// Set when started as verify, there's no flag for it
+var verifyonly bool
+
+// pickcommand takes the command off the arguments. Without one it's a run that takes
+// every flag, like before there were commands.
+func pickcommand(args []string) (*command, []string) {
+	if len(args) > 0 {
+		for i := range commands {
+			if commands[i].name == args[0] {
+				return &commands[i], args[1:]
+			}
+		}
+	}
+	return nil, args
+}
+
+// restrictflags hides the flags that don't apply to the command from its help
+func (c *command) restrictflags(fs *pflag.FlagSet) {
+	allowed := c.allowed(fs)
+	fs.VisitAll(func(f *pflag.Flag) {
+		if !allowed[f.Name] {
+			f.Hidden = true
+		}
+	})
+}
+
+func (c *command) allowed(fs *pflag.FlagSet) map[string]bool {
+	allowed := map[string]bool{}
+	if c.flags == nil {
+		fs.VisitAll(func(f *pflag.Flag) {
+			allowed[f.Name] = true
+		})
+		for _, name := range modeflags {
+			delete(allowed, name)
+		}
+		return allowed
+	}
+	for _, name := range flaglist(commonflags, c.flags) {
+		allowed[name] = true
+	}
+	return allowed
+}
+
+// setup checks that only flags for the command were given, and switches on its mode
+func (c *command) setup(fs *pflag.FlagSet) error {
+	allowed := c.allowed(fs)
+	var wrong []string
+	fs.Visit(func(f *pflag.Flag) {
+		if !allowed[f.Name] {
+			wrong = append(wrong, "--"+f.Name)
+		}
+	})
+	if len(wrong) > 0 {
+		sort.Strings(wrong)
+		if len(wrong) > 1 {
+			return fmt.Errorf("%s don't apply to the %s command", strings.Join(wrong, ", "), c.name)
+		}
+		return fmt.Errorf("%s doesn't apply to the %s command", wrong[0], c.name)
+	}
+	for name, value := range c.mode {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	verifyonly = c.name == "verify"
+	return nil
+}
+
+// usage shows the commands, and the flags of the one picked if any
+func usage(c *command, fs *pflag.FlagSet) func() {
+	return func() {
+		out := os.Stderr
+		if c == nil {
+			fmt.Fprintf(out, "Usage: %s [command] [flags] [paths]\n\nCommands:\n", os.Args[0])
+			for _, c := range commands {
+				fmt.Fprintf(out, "  %-15s %s\n", c.name, c.description)
+			}
+			fmt.Fprintf(out, "\nWithout a command it is a run, and all flags are accepted. Flags:\n")
+		} else {
+			fmt.Fprintf(out, "Usage: %s %s [flags] [paths]\n\n%s\n\nFlags:\n", os.Args[0], c.name, c.description)
+		}
+		fmt.Fprint(out, fs.FlagUsages())
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZFS allocates in sectors, and only keeps a record compressed if that saves at least an eighth
+const comparesector = 4096
+
+// compressor compresses one record and returns the compressed size
+type compressor func(record []byte) int
+
+// comparealgorithm is a compressor standing in for a ZFS compression setting
+type comparealgorithm struct {
+	name string
+	new  func() compressor // one per worker, encoders aren't safe to share
+}
+
+var comparealgorithms = []comparealgorithm{
+	{"lz4 (snappy)", func() compressor {
+		// There's no lz4 at hand, snappy is in the same class of fast and light
+		var dst []byte
+		return func(record []byte) int {
+			dst = s2.EncodeSnappy(dst[:0], record)
+			return len(dst)
+		}
+	}},
+	{"gzip-1", flatecompressor(1)},
+	{"gzip-6", flatecompressor(6)},
+	{"gzip-9", flatecompressor(9)},
+	// The Go zstd levels roughly match these of the reference implementation
+	{"zstd-1", zstdcompressor(zstd.SpeedFastest)},
+	{"zstd-3", zstdcompressor(zstd.SpeedDefault)},
+	{"zstd-7", zstdcompressor(zstd.SpeedBetterCompression)},
+	{"zstd-11", zstdcompressor(zstd.SpeedBestCompression)},
+}
+
+func flatecompressor(level int) func() compressor {
+	return func() compressor {
+		var out bytes.Buffer
+		w, _ := flate.NewWriter(&out, level)
+		return func(record []byte) int {
+			out.Reset()
+			w.Reset(&out)
+			w.Write(record)
+			w.Close()
+			return out.Len()
+		}
+	}
+}
+
+func zstdcompressor(level zstd.EncoderLevel) func() compressor {
+	return func() compressor {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		var dst []byte
+		return func(record []byte) int {
+			dst = enc.EncodeAll(record, dst[:0])
+			return len(dst)
+		}
+	}
+}
+
+// allocated is roughly what ZFS would use on disk for a record compressed to compressed bytes
+func allocated(recordsize, compressed int) uint64 {
+	roundup := func(n int) uint64 {
+		return uint64((n + comparesector - 1) / comparesector * comparesector)
+	}
+	if roundup(compressed) > roundup(recordsize)-roundup(recordsize)/8 {
+		return roundup(recordsize)
+	}
+	return roundup(compressed)
+}
+
+// comparestats adds up what the algorithms did for one extension
+type comparestats struct {
+	files    uint64
+	total    uint64 // size of the files
+	size     uint64 // of the records looked at, all of them without --test-block-size
+	plain    uint64 // allocated without compression, but with holes for records of zeroes
+	fed      uint64 // bytes run through each compressor, holes aren't
+	alloc    []uint64
+	duration []time.Duration
+}
+
+func newcomparestats() *comparestats {
+	return &comparestats{
+		alloc:    make([]uint64, len(comparealgorithms)),
+		duration: make([]time.Duration, len(comparealgorithms)),
+	}
+}
+
+func (cs *comparestats) add(o *comparestats) {
+	cs.files += o.files
+	cs.total += o.total
+	cs.size += o.size
+	cs.plain += o.plain
+	cs.fed += o.fed
+	for i := range cs.alloc {
+		cs.alloc[i] += o.alloc[i]
+		cs.duration[i] += o.duration[i]
+	}
+}
+
+// comparealgorithmsfor reads the files below the roots, sampled with --sample,
+// and compresses every record with each of the algorithms in memory. Nothing is written.
+func comparealgorithmsfor(roots []string) error {
+	byext := map[string]*comparestats{}
+	var lock sync.Mutex
+
+	queue := make(chan string, *queuesize)
+	var workers sync.WaitGroup
+	for i := 0; i < int(*threads); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			compressors := make([]compressor, len(comparealgorithms))
+			for i, algorithm := range comparealgorithms {
+				compressors[i] = algorithm.new()
+			}
+			// Whole records, but no more than --buffersize allows
+			buffer := make([]byte, max(holesize, int(*buffersize))/holesize*holesize)
+			for fp := range queue {
+				cs, err := comparefile(fp, compressors, buffer)
+				if err != nil {
+					logerror("Error reading %s, leaving it out: %v", fp, err)
+					continue
+				}
+				ext := strings.ToLower(filepath.Ext(fp))
+				if ext == "" {
+					ext = "(none)"
+				}
+				lock.Lock()
+				if byext[ext] == nil {
+					byext[ext] = newcomparestats()
+				}
+				byext[ext].add(cs)
+				lock.Unlock()
+			}
+		}()
+	}
+
+	var err error
+	for _, root := range roots {
+		var rootdev uint64
+		if rootinfo, err := os.Stat(root); err == nil {
+			rootdev = uint64(rootinfo.Sys().(*syscall.Stat_t).Dev)
+		}
+		err = filepath.WalkDir(root, func(fp string, di os.DirEntry, err error) error {
+			if abort.Load() {
+				return errors.New("Aborted due to interrupt")
+			}
+			if err != nil {
+				logerror("Error walking %s, skipping it: %v", fp, err)
+				return nil
+			}
+			if *onefilesystem && di.IsDir() && fp != root {
+				fileinfo, err := di.Info()
+				if err == nil && uint64(fileinfo.Sys().(*syscall.Stat_t).Dev) != rootdev {
+					return filepath.SkipDir
+				}
+			}
+			if fp != root && pseudofsdir(fp, di, rootdev) != "" {
+				return filepath.SkipDir
+			}
+			if di.IsDir() && strings.HasPrefix(di.Name(), resumedbname) {
+				return filepath.SkipDir
+			}
+			if len(excludes) > 0 && fp != root {
+				rel, _ := filepath.Rel(root, fp)
+				if excluded(rel, di.IsDir()) != "" {
+					if di.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+			if pattern, _ := walkignorefiles(fp, di.IsDir()); pattern != "" {
+				if di.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !di.Type().IsRegular() || strings.HasPrefix(di.Name(), tempprefix) {
+				return nil
+			}
+			if *samplerate < 1 {
+				samplelock.Lock()
+				picked := sampler.Float64() < *samplerate
+				samplelock.Unlock()
+				if !picked {
+					return nil
+				}
+			}
+			queue <- fp
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	close(queue)
+	workers.Wait()
+	if err != nil {
+		return err
+	}
+
+	// Biggest extensions first, they matter most
+	exts := make([]string, 0, len(byext))
+	total := newcomparestats()
+	for ext, cs := range byext {
+		exts = append(exts, ext)
+		total.add(cs)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		return byext[exts[i]].total > byext[exts[j]].total
+	})
+
+	header := fmt.Sprintf("%-12s %8s %14s %6s", "extension", "files", "bytes", "none")
+	for _, algorithm := range comparealgorithms {
+		header += fmt.Sprintf(" %12s", algorithm.name)
+	}
+	if testblocksize > 0 {
+		log("Compression ratios as ZFS would store the data, in %v KiB records on %v byte sectors, from %s of each file (--test-block-size):", holesize>>10, comparesector, *testblocksizevalue)
+	} else {
+		log("Compression ratios as ZFS would store the data, in %v KiB records on %v byte sectors:", holesize>>10, comparesector)
+	}
+	log("%s", header)
+	row := func(name string, cs *comparestats) {
+		line := fmt.Sprintf("%-12s %8v %14v %6s", name, cs.files, cs.total, ratio(cs.size, cs.plain))
+		for i := range comparealgorithms {
+			line += fmt.Sprintf(" %12s", ratio(cs.size, cs.alloc[i]))
+		}
+		log("%s", line)
+	}
+	for _, ext := range exts {
+		row(ext, byext[ext])
+	}
+	row("all", total)
+
+	log("Speed per thread:")
+	for i, algorithm := range comparealgorithms {
+		speed := 0.0
+		if total.duration[i] > 0 {
+			speed = float64(total.fed) / total.duration[i].Seconds() / (1 << 20)
+		}
+		log("%-12s %8.1f MiB/s", algorithm.name, speed)
+	}
+	return nil
+}
+
+// ratio formats size over alloc, files that are all holes have no ratio to speak of
+func ratio(size, alloc uint64) string {
+	if alloc == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", float64(size)/float64(alloc))
+}
+
+// How much of each file --compare-algorithms compresses, 0 for all of it
+var testblocksize uint64
+var testblocksizevalue *string // as given, for messages
+
+// comparefile runs the records of the file through all the compressors, all of them
+// or with --test-block-size as many as that takes, spread evenly from the start to the end
+func comparefile(fp string, compressors []compressor, buffer []byte) (*comparestats, error) {
+	f, err := opensource(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cs := newcomparestats()
+	cs.files = 1
+	records := func(n int) {
+		for offset := 0; offset < n; offset += holesize {
+			record := buffer[offset:min(offset+holesize, n)]
+			cs.size += uint64(len(record))
+			if bytes.Equal(record, zeroes[:len(record)]) {
+				// A hole, no space used whatever the algorithm
+				continue
+			}
+			cs.plain += allocated(len(record), len(record))
+			cs.fed += uint64(len(record))
+			for i, compress := range compressors {
+				start := time.Now()
+				compressed := compress(record)
+				cs.duration[i] += time.Since(start)
+				cs.alloc[i] += allocated(len(record), compressed)
+			}
+		}
+	}
+
+	fileinfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(fileinfo.Size())
+	cs.total = size
+	if testblocksize > 0 && testblocksize < size {
+		count := (size + holesize - 1) / holesize
+		samples := min(count, (testblocksize+holesize-1)/holesize)
+		for i := uint64(0); i < samples; i++ {
+			n, err := f.ReadAt(buffer[:holesize], int64(i*count/samples*holesize))
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			records(n)
+		}
+		return cs, nil
+	}
+
+	for {
+		n, err := io.ReadFull(f, buffer)
+		records(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return cs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// configoption is one flag as --print-effective-config shows it
+type configoption struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+type effectiveconfig struct {
+	Command string         `json:"command"`
+	Paths   []string       `json:"paths"`
+	Ignore  []string       `json:"ignored_extensions"`
+	Options []configoption `json:"options"`
+}
+
+// givenflags returns the flags on the command line with their values, taken right
+// after parsing so it's known later what the command and other flags changed
+func givenflags(fs *pflag.FlagSet) map[string]string {
+	given := map[string]string{}
+	fs.Visit(func(f *pflag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+	return given
+}
+
+// flagsource tells where the value of the flag came from. There are no config files
+// or environment variables, so it's the command line, the command, or the default -
+// unless another flag changed it, like --safe turning on --fsync.
+func flagsource(f *pflag.Flag, given map[string]string, cmd *command) string {
+	value := f.Value.String()
+	if givenvalue, ok := given[f.Name]; ok {
+		if givenvalue != value {
+			return "command line, changed by other options"
+		}
+		return "command line"
+	}
+	if cmd != nil {
+		if _, ok := cmd.mode[f.Name]; ok {
+			return cmd.name + " command"
+		}
+	}
+	if value != f.DefValue {
+		return "other options"
+	}
+	return "default"
+}
+
+// printeffectiveconfig shows every flag that applies to the command with its value
+// after all the checks and adjustments, and where that came from
+func printeffectiveconfig(fs *pflag.FlagSet, given map[string]string, cmd *command, asjson bool) error {
+	config := effectiveconfig{Command: "run", Paths: fs.Args(), Ignore: ignorelist}
+	if cmd != nil {
+		config.Command = cmd.name
+	}
+	if len(config.Paths) == 0 && !*alldatasets {
+		config.Paths = []string{"."}
+	}
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Hidden || f.Name == "print-effective-config" || f.Name == "json" {
+			return
+		}
+		config.Options = append(config.Options, configoption{f.Name, f.Value.String(), flagsource(f, given, cmd)})
+	})
+
+	if asjson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(config)
+	}
+	log("Command: %s", config.Command)
+	if *alldatasets {
+		log("Paths: every mounted dataset with compression on")
+	} else {
+		log("Paths: %s", strings.Join(config.Paths, " "))
+	}
+	log("Ignored extensions: %s", strings.Join(config.Ignore, " "))
+	width := 0
+	for _, o := range config.Options {
+		width = max(width, len(o.Name))
+	}
+	for _, o := range config.Options {
+		log("  --%-*s  %-24s  %s", width, o.Name, o.Value, o.Source)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// csvreport writes a row for every file the workers got to with --csv, for
+// looking at in a spreadsheet. Each row is flushed right away, so what was
+// written survives the run being interrupted.
+type csvreport struct {
+	sync.Mutex
+	f *os.File
+	w *csv.Writer
+}
+
+var csvout *csvreport
+
+var csvheader = []string{"path", "inode", "size", "ondisk_before", "ondisk_after", "saved", "action", "reason", "duration_seconds", "error"}
+
+var actionnames = map[fileaction]string{
+	actionfailed:    "failed",
+	actionskipped:   "skipped",
+	actionrewritten: "rewritten",
+	actionkept:      "kept",
+}
+
+// opencsv starts the file over, with the header as the first row
+func opencsv(fp string) (*csvreport, error) {
+	f, err := os.Create(fp)
+	if err != nil {
+		return nil, err
+	}
+	c := &csvreport{f: f, w: csv.NewWriter(f)}
+	if err := c.write(csvheader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *csvreport) write(row []string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.w.Write(row)
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// record writes the row for one file. The on-disk size after a rewrite is what
+// the file uses right away, ZFS may still change it a little once the data is
+// synced to the pool. A file left alone is stat'ed here as it's still the same.
+func (c *csvreport) record(fp string, result fileresult, took time.Duration, err error) error {
+	action := actionnames[result.action]
+	if err != nil {
+		action = actionnames[actionfailed]
+	}
+	size := strconv.FormatInt(result.size, 10)
+	var inode, before, after, saved string
+	if result.inode != 0 {
+		inode = strconv.FormatUint(result.inode, 10)
+		before = strconv.FormatInt(result.ondisk, 10)
+	}
+	switch {
+	case err != nil || result.action == actionskipped:
+		if fileinfo, staterr := os.Lstat(fp); staterr == nil {
+			if sysstat, ok := fileinfo.Sys().(*syscall.Stat_t); ok {
+				inode = strconv.FormatUint(uint64(sysstat.Ino), 10)
+				before = strconv.FormatInt(int64(sysstat.Blocks)*512, 10)
+				if err == nil {
+					after, saved = before, "0"
+				} else if result.size == 0 {
+					size = strconv.FormatInt(fileinfo.Size(), 10)
+				}
+			}
+		}
+	case *dryrun != "":
+	case result.action == actionkept:
+		after, saved = before, "0"
+	case result.action == actionrewritten:
+		written := fp
+		if *mirrorto != "" {
+			written = filepath.Join(*mirrorto, fp)
+		}
+		if fileinfo, err := os.Lstat(written); err == nil {
+			if sysstat, ok := fileinfo.Sys().(*syscall.Stat_t); ok {
+				ondisk := int64(sysstat.Blocks) * 512
+				after = strconv.FormatInt(ondisk, 10)
+				saved = strconv.FormatInt(result.ondisk-ondisk, 10)
+			}
+		}
+	}
+	var errtext string
+	if err != nil {
+		errtext = err.Error()
+	}
+	return c.write([]string{fp, inode, size, before, after, saved,
+		action, result.reason, strconv.FormatFloat(took.Seconds(), 'f', 6, 64), errtext})
+}
+
+func (c *csvreport) close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// excludepattern is one --exclude pattern, matched against paths relative to the directory being processed
+type excludepattern struct {
+	text     string   // as given, for messages
+	parts    []string // split on slashes, ** matches any number of directories
+	anchored bool     // has a slash, so it matches from the top instead of any file or directory name
+	dironly  bool     // ended with a slash, so it only matches directories
+}
+
+var excludes []excludepattern
+
+// parseexclude works like a line in a .gitignore, except that negating with ! isn't supported
+func parseexclude(text string) (excludepattern, error) {
+	p := excludepattern{text: text}
+	pattern := text
+	if strings.HasPrefix(pattern, "!") {
+		return p, fmt.Errorf("exclude pattern %q: negating patterns is not supported", text)
+	}
+	if strings.HasSuffix(pattern, "/") {
+		p.dironly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		p.anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	if pattern == "" {
+		return p, fmt.Errorf("exclude pattern %q matches nothing", text)
+	}
+	p.parts = strings.Split(pattern, "/")
+	for _, part := range p.parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return p, fmt.Errorf("exclude pattern %q: %v", text, err)
+		}
+	}
+	return p, nil
+}
+
+// readexcludes reads patterns one per line, skipping blank lines and # comments
+func readexcludes(fp string) ([]excludepattern, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []excludepattern
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		p, err := parseexclude(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %v: %w", fp, line, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, scanner.Err()
+}
+
+// excluded returns the pattern matching the relative path, if any
+func excluded(rel string, isdir bool) string {
+	return matchexcludes(excludes, rel, isdir)
+}
+
+func matchexcludes(patterns []excludepattern, rel string, isdir bool) string {
+	rel = filepath.ToSlash(rel)
+	for _, p := range patterns {
+		if p.dironly && !isdir {
+			continue
+		}
+		if p.anchored {
+			if matchparts(p.parts, strings.Split(rel, "/")) {
+				return p.text
+			}
+		} else if ok, _ := path.Match(p.parts[0], path.Base(rel)); ok {
+			return p.text
+		}
+	}
+	return ""
+}
+
+// excludedpath is like excluded, but also checks the directories leading up to the file
+func excludedpath(rel string) string {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	dirs := strings.Split(rel, "/")
+	for i := 1; i < len(dirs); i++ {
+		if pattern := excluded(strings.Join(dirs[:i], "/"), true); pattern != "" {
+			return pattern
+		}
+	}
+	return excluded(rel, false)
+}
+
+func matchparts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try swallowing no directories, then one more at a time
+			for i := 0; i <= len(name); i++ {
+				if matchparts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// explain runs the same checks as processfile on a single file, and shows
+// what each of them found and which one (if any) would cause a skip
+func explain(fp string) error {
+	fileinfo, err := os.Lstat(fp)
+	if err != nil {
+		return err
+	}
+	if !fileinfo.Mode().IsRegular() {
+		log("%s is not a regular file (%v), it is never processed", fp, fileinfo.Mode().Type())
+		return nil
+	}
+	sysstat, ok := fileinfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unknown file type %T", fileinfo.Sys())
+	}
+
+	var reason string
+	check := func(name string, skip bool, format string, args ...interface{}) {
+		verdict := "pass"
+		if skip {
+			verdict = "SKIP"
+			if reason == "" {
+				reason = name
+			}
+		}
+		log("%-18s %s  %s", name, verdict, fmt.Sprintf(format, args...))
+	}
+
+	check("temporary file", strings.HasPrefix(fileinfo.Name(), tempprefix),
+		"name is %s, temporary files start with %s", fileinfo.Name(), tempprefix)
+	if pattern := excludedpath(fp); pattern != "" {
+		check("exclude patterns", true, "path matches %s", pattern)
+	} else {
+		check("exclude patterns", false, "path doesn't match any of the %v patterns", len(excludes))
+	}
+	if *useignorefiles {
+		if pattern, file := explainignorefiles(fp); pattern != "" {
+			check("ignore files", true, "path matches %s in %s", pattern, file)
+		} else {
+			check("ignore files", false, "path doesn't match any pattern in the %s files above it", strings.Join(ignorefilenames, " or "))
+		}
+	}
+	check("minimum size", fileinfo.Size() <= *minfilesize,
+		"file is %v bytes, must be more than %v", fileinfo.Size(), *minfilesize)
+	if *sincelastrun {
+		last, err := loadlastrun(resumedbpath(".", ""))
+		switch {
+		case err != nil:
+			check("since last run", false, "can't read the time of the last run: %v", err)
+		case last.IsZero():
+			check("since last run", false, "there was no earlier run")
+		default:
+			check("since last run", !fileinfo.ModTime().After(last),
+				"file was modified %v, the last run was %v", fileinfo.ModTime(), last)
+		}
+	}
+	if *excludenewerthansnapshot {
+		explainsnapshot(fp, sysstat, check)
+	}
+	if suffix := ignoredsuffix(fp); suffix != "" {
+		check("ignore list", true, "name ends with %s", suffix)
+	} else {
+		check("ignore list", false, "name doesn't match any of the %v entries", len(ignorelist))
+	}
+	if reason := wrongowner(sysstat); reason != "" {
+		check("owner", true, "file is %s", reason)
+	} else {
+		check("owner", false, "uid %v and gid %v match --owner and --group, if given", sysstat.Uid, sysstat.Gid)
+	}
+	recompressed := explainresume(fp, fileinfo, sysstat, check)
+	due := stale(fileinfo, recompressed)
+	if *rewriteolderthan > 0 {
+		what, verdict := "written", "pass"
+		if recompressed != 0 && time.Unix(0, recompressed).After(fileinfo.ModTime()) {
+			what = "recompressed"
+		}
+		if due {
+			verdict = "DUE "
+		}
+		log("%-18s %s  file was last %s %v, rewritten whatever its ratio after %v", "rewrite older than", verdict,
+			what, lastwritten(fileinfo, recompressed).Format(time.RFC3339), *rewriteolderthan)
+	}
+	if *skipminimal {
+		check("minimal on disk", minimalondisk(fileinfo.Size(), sysstat.Blocks*512),
+			"%v bytes in %v bytes, a single record of %v bytes uses at least %v bytes", fileinfo.Size(), sysstat.Blocks*512,
+			recordsize, minsector)
+	}
+	verdict := zdbunknown
+	if *zdbcheck {
+		setupzdb(fp, uint64(sysstat.Dev))
+		var detail string
+		verdict, detail = zdbcheckfile(fp, sysstat)
+		switch verdict {
+		case zdbdone:
+			check("zdb blocks", !due, "zdb shows %s", detail)
+		case zdbdue:
+			check("zdb blocks", false, "zdb shows %s, so it is rewritten whatever its ratio", detail)
+		default:
+			check("zdb blocks", false, "zdb can't tell, the compression ratio decides")
+		}
+	}
+	ratio := float64(fileinfo.Size()) / float64(sysstat.Blocks*512)
+	check("compression ratio", alreadycompressed(fileinfo, sysstat) && !due && verdict != zdbdue,
+		"%v bytes stored in %v bytes is %.2f:1, skipped above %v:1 (0 = never)", fileinfo.Size(), sysstat.Blocks*512, ratio, *skipratio)
+	check("empty file", fileinfo.Size() == 0, "file is %v bytes", fileinfo.Size())
+	check("hardlinks", *onlyifsmaller && sysstat.Nlink > 1,
+		"file has %v links, hardlinked files are skipped with --only-if-smaller", sysstat.Nlink)
+	if len(mimepatterns) > 0 {
+		mediatype, err := sniffmime(fp, make([]byte, sniffsize))
+		if err != nil {
+			check("mime", false, "can't tell the type, reading it failed: %v", err)
+		} else {
+			check("mime", !mimewanted(mediatype), "file looks like %s, --mime wants %s", mediatype, strings.Join(mimepatterns, ", "))
+		}
+	}
+
+	if reason == "" {
+		log("%s would be recompressed", fp)
+	} else {
+		log("%s would be skipped by the %s check", fp, reason)
+	}
+	return nil
+}
+
+// explainresume shows what the resume database knows about the file, and returns when
+// it was last recompressed if that's known
+func explainresume(fp string, fileinfo os.FileInfo, sysstat *syscall.Stat_t, check func(string, bool, string, ...interface{})) int64 {
+	dbpath := resumedbpath(".", "")
+	switch {
+	case *noresume:
+		check("resume database", false, "not used with --noresume")
+		return 0
+	case dbpath == "":
+		check("resume database", false, "kept in memory only, so it's empty when starting")
+		return 0
+	}
+	if _, err := os.Stat(dbpath); err != nil {
+		check("resume database", false, "there is no resume database at %s", dbpath)
+		return 0
+	}
+	db, err := badger.Open(badger.DefaultOptions(dbpath).WithReadOnly(true).WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		check("resume database", false, "can't open %s: %v", dbpath, err)
+		return 0
+	}
+	defer db.Close()
+
+	entry, found, err := resumeget(db, statfileid(sysstat))
+	switch {
+	case err != nil:
+		check("resume database", false, "lookup failed: %v", err)
+	case !found:
+		check("resume database", false, "file has not been handled yet")
+	case stale(fileinfo, entry.recompressed):
+		check("resume database", false, "file was handled, but it's due again by --rewrite-older-than")
+	case entry.matches(fileinfo):
+		check("resume database", true, "file was handled and hasn't changed since")
+	case *checksumcache && entry.hash != nil:
+		hash, err := hashfile(fp, make([]byte, 1024*1024))
+		if err != nil {
+			check("resume database", false, "file changed since it was handled, and reading it failed: %v", err)
+			return 0
+		}
+		check("resume database", bytes.Equal(hash, entry.hash),
+			"file was handled at size %v modified %v, now size %v modified %v, checksum %x vs stored %x",
+			entry.size, time.Unix(0, entry.mtime), fileinfo.Size(), fileinfo.ModTime(), hash, entry.hash)
+	default:
+		check("resume database", false,
+			"file was handled at size %v modified %v, but is now size %v modified %v",
+			entry.size, time.Unix(0, entry.mtime), fileinfo.Size(), fileinfo.ModTime())
+	}
+	return entry.recompressed
+}
+
+func explainsnapshot(fp string, sysstat *syscall.Stat_t, check func(string, bool, string, ...interface{})) {
+	name, err := datasetforpath(fp)
+	if err != nil {
+		check("latest snapshot", false, "can't find the dataset: %v", err)
+		return
+	}
+	snapshot, created, err := latestsnapshot(name)
+	switch {
+	case err != nil:
+		check("latest snapshot", false, "can't find the latest snapshot of %s: %v", name, err)
+	case snapshot == "":
+		check("latest snapshot", true, "dataset %s has no snapshots, so the whole dataset is skipped", name)
+	default:
+		check("latest snapshot", statctime(sysstat).After(created),
+			"file was changed %v, the latest snapshot %s is of %v", statctime(sysstat), snapshot, created)
+	}
+}
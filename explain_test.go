@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// --explain tells about the files --mime skips, like the run does
+func TestExplainMime(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "file.txt")
+	writefile(t, fp, 64<<10, []byte("some text\n"))
+	t.Cleanup(func() { mimepatterns = nil })
+	for pattern, want := range map[string]string{
+		"image/*": "would be skipped by the mime check",
+		"text/*":  "would be recompressed",
+	} {
+		// Parsed by main, not by the flags themselves
+		testflags(t)
+		mimepatterns = []string{pattern}
+		var out bytes.Buffer
+		logout = &out
+		if err := explain(fp); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("--explain with --mime %s doesn't say the file %s:\n%s", pattern, want, out.String())
+		}
+	}
+}
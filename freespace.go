@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Files aren't started while the dataset has less than this many bytes available, 0 for no check
+var minfree uint64
+var minfreevalue *string // as given, for messages
+
+// How old the available space may be before asking zfs again
+const freespaceinterval = 2 * time.Second
+
+// Starting nothing while no file is being rewritten frees no space, so after
+// waiting this long the file is skipped instead
+const freespacepatience = time.Minute
+
+// Time workers spent waiting for space
+var freespacewaited atomic.Int64
+
+// freespacewatch keeps new files from starting when the space they take would bring
+// the dataset below --min-free. Copies take their size until they replace the
+// original, in place rewrites only hold on to old blocks until the transaction
+// group is synced, so those only wait while space is short.
+type freespacewatch struct {
+	sync.Mutex
+	dataset   string
+	available int64
+	known     bool // zfs told us at least once, until then there's no holding back
+	checked   time.Time
+	reserved  int64 // by files being written now
+	inflight  int
+	short     bool // waiting for space, to log only when that starts and ends
+}
+
+var freespace *freespacewatch
+
+// watchfreespace sets up the --min-free check for the dataset files under root are written to
+func watchfreespace(root string) *freespacewatch {
+	if minfree == 0 {
+		return nil
+	}
+	target := root
+	if *mirrorto != "" {
+		target = *mirrorto
+	}
+	name, err := datasetforpath(target)
+	if err != nil {
+		logerror("Not checking for --min-free, can't find the dataset of %s: %v", target, err)
+		return nil
+	}
+	return &freespacewatch{dataset: name}
+}
+
+func (w *freespacewatch) refresh() {
+	if time.Since(w.checked) < freespaceinterval {
+		return
+	}
+	value, err := zfsget(w.dataset, "available")
+	if err == nil {
+		var available uint64
+		if available, err = strconv.ParseUint(value, 10, 64); err == nil {
+			w.available = int64(available)
+			w.known = true
+		}
+	}
+	if err != nil {
+		debug("Failed to get the available space of dataset %s: %v", w.dataset, err)
+	}
+	w.checked = time.Now()
+}
+
+// reserve waits until need more bytes can be written without going below --min-free,
+// and returns false when that doesn't happen. A nil watch always has room.
+func (w *freespacewatch) reserve(fp string, need int64) bool {
+	if w == nil {
+		return true
+	}
+	w.Lock()
+	defer w.Unlock()
+	var waiting time.Time
+	for {
+		w.refresh()
+		if !w.known || w.available-w.reserved-need >= int64(minfree) {
+			break
+		}
+		if waiting.IsZero() {
+			waiting = time.Now()
+			if !w.short {
+				w.short = true
+				log("Dataset %s has %s available, less than --min-free %s with what is being written, waiting for space before starting more files",
+					w.dataset, humanize.IBytes(uint64(max(0, w.available))), *minfreevalue)
+			}
+		}
+		if w.inflight == 0 && time.Since(waiting) > freespacepatience {
+			timed(&freespacewaited, waiting)
+			logerror("Skipping file %s, writing %s would leave less than --min-free %s on dataset %s", fp, humanize.IBytes(uint64(need)), *minfreevalue, w.dataset)
+			return false
+		}
+		if stopped() != nil {
+			return false
+		}
+		w.Unlock()
+		time.Sleep(freespaceinterval / 4)
+		w.Lock()
+	}
+	if !waiting.IsZero() {
+		timed(&freespacewaited, waiting)
+	}
+	if w.short {
+		w.short = false
+		log("Dataset %s has %s available again, carrying on", w.dataset, humanize.IBytes(uint64(w.available)))
+	}
+	w.reserved += need
+	w.inflight++
+	return true
+}
+
+// release gives back what reserve took, once the file is written
+func (w *freespacewatch) release(need int64) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	w.reserved -= need
+	w.inflight--
+	w.Unlock()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errfsunavailable means the filesystem being worked on went away, say the dataset
+// was unmounted or a network mount dropped, so every file left would fail too
+var errfsunavailable = errors.New("Filesystem unavailable")
+
+// Exit code when the filesystem went away, so a scheduler can tell it from files failing
+const exitfsunavailable = 4
+
+// How many errors like that in a row stop the run, even if the root still looks fine
+const fsgoneburst = 8
+
+var fsunavailable atomic.Bool
+var fsgonestreak atomic.Int64
+
+var mountcheckinterval *time.Duration
+
+// fsgoneerror tells if the error is one a filesystem that is gone gives for everything
+func fsgoneerror(err error) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENOTCONN)
+}
+
+// rootgone tells if root isn't on the device it was on when the run started anymore.
+// An unmounted dataset leaves its mountpoint behind, on the filesystem below it.
+func rootgone(root string, rootdev uint64) bool {
+	info, err := os.Stat(root)
+	return err != nil || uint64(info.Sys().(*syscall.Stat_t).Dev) != rootdev
+}
+
+// checkfsgone looks at what happened to a file, and stops the run once the filesystem
+// is gone: after any error the root is checked, and errors only a filesystem that is
+// gone gives stop it too when they keep coming. It returns true when the error is
+// down to that and not worth reporting on its own.
+func checkfsgone(root string, rootdev uint64, err error) bool {
+	if err == nil {
+		fsgonestreak.Store(0)
+		return false
+	}
+	if fsunavailable.Load() {
+		return true
+	}
+	streak := int64(0)
+	if fsgoneerror(err) {
+		streak = fsgonestreak.Add(1)
+	} else {
+		fsgonestreak.Store(0)
+	}
+	if streak < fsgoneburst && !rootgone(root, rootdev) {
+		return false
+	}
+	if !fsunavailable.Swap(true) {
+		logerror("The filesystem of %s is not available anymore (%v), stopping", root, err)
+	}
+	return true
+}
+
+// watchmount checks that root is still there every --mount-check-interval, so a
+// run doesn't carry on below a mountpoint that has nothing mounted on it anymore.
+// Call stop when done.
+func watchmount(root string, rootdev uint64) (stop func()) {
+	if *mountcheckinterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	interval := *mountcheckinterval
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if rootgone(root, rootdev) && !fsunavailable.Swap(true) {
+				logerror("The filesystem of %s is not mounted anymore, stopping", root)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+var starttime = time.Now()
+
+// Files being worked on right now
+var inflight atomic.Int64
+
+var heartbeattotal *bool
+
+// heartbeatline is what --heartbeat prints, one JSON object per line
+type heartbeatline struct {
+	Time         time.Time `json:"time"`
+	Elapsed      float64   `json:"elapsed_seconds"`
+	Files        uint64    `json:"files"`
+	Bytes        uint64    `json:"bytes"`
+	SkippedFiles uint64    `json:"skipped_files"`
+	SkippedBytes uint64    `json:"skipped_bytes"`
+	FreedBytes   uint64    `json:"freed_bytes"`
+	FilesPerSec  float64   `json:"files_per_second"`
+	BytesPerSec  float64   `json:"bytes_per_second"`
+	InFlight     int64     `json:"in_flight"`
+	Queued       int       `json:"queued"`
+	Errors       uint64    `json:"errors"`
+
+	// With --heartbeat-total, once the files are counted
+	TotalFiles uint64  `json:"total_files,omitempty"`
+	TotalBytes uint64  `json:"total_bytes,omitempty"`
+	DoneBytes  uint64  `json:"done_bytes,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	ETA        float64 `json:"eta_seconds,omitempty"`
+}
+
+// heartbeattotals is how much the job has to do in all, for --heartbeat-total.
+// What the resume database has as done counts as done from the start, so a
+// resumed run doesn't begin at 0%.
+type heartbeattotals struct {
+	files, bytes atomic.Uint64 // files to do, 0 until counted
+	handledbytes uint64        // in the resume database when the run started
+	started      time.Time
+}
+
+// starttotals counts the files below root in the background, like
+// --confirm-above does, and how much of them the resume database has as done
+func starttotals(root string, db *badger.DB) *heartbeattotals {
+	t := &heartbeattotals{started: time.Now()}
+	if db != nil {
+		bytes, err := resumehandled(db)
+		if err != nil {
+			logerror("Failed to count what the resume database has as done: %v", err)
+		}
+		t.handledbytes = bytes
+	}
+	go func() {
+		counted, err := precount(root, 0, 0)
+		if err != nil {
+			logerror("Failed to count the files for --heartbeat-total: %v", err)
+			return
+		}
+		t.bytes.Store(counted.size)
+		t.files.Store(counted.files)
+	}()
+	return t
+}
+
+// resumehandled adds up the sizes in the resume entries
+func resumehandled(db *badger.DB) (bytes uint64, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if len(item.Key()) != 8 && len(item.Key()) != 16 {
+				continue
+			}
+			err := item.Value(func(val []byte) error {
+				if entry, ok := decoderesumeentry(val); ok {
+					bytes += uint64(entry.size)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return bytes, err
+}
+
+// add puts how far along the run is into the line. Files done again, like with
+// --rewrite-older-than, were counted as done from the start already.
+func (t *heartbeattotals) add(line *heartbeatline, stats []workerstats, now time.Time) {
+	if t == nil || t.files.Load() == 0 {
+		return
+	}
+	var done, again uint64
+	for i := range stats {
+		done += stats[i].done.Load()
+		again += stats[i].handled.Load()
+	}
+	done -= min(done, again)
+	line.TotalFiles = t.files.Load()
+	line.TotalBytes = t.bytes.Load()
+	line.DoneBytes = min(t.handledbytes+done, line.TotalBytes)
+	if line.TotalBytes > 0 {
+		line.Percent = 100 * float64(line.DoneBytes) / float64(line.TotalBytes)
+	}
+	if rate := float64(done) / now.Sub(t.started).Seconds(); rate > 0 {
+		line.ETA = float64(line.TotalBytes-line.DoneBytes) / rate
+	}
+}
+
+// heartbeat writes the stats to stderr every interval until stop is closed
+func heartbeat(stats []workerstats, queue chan queueItem, interval time.Duration, totals *heartbeattotals, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	encoder := json.NewEncoder(os.Stderr)
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			line := heartbeatline{
+				Time:         now,
+				Elapsed:      now.Sub(starttime).Seconds(),
+				Files:        totalfiles.Load(),
+				Bytes:        totalbytes.Load(),
+				SkippedFiles: skipfiles.Load(),
+				SkippedBytes: skipbytes.Load(),
+				FreedBytes:   savedbytes.Load(),
+				InFlight:     inflight.Load(),
+				Queued:       len(queue),
+				Errors:       fileerrors.Load() + walkerrors.Load(),
+			}
+			for i := range stats {
+				ws := &stats[i]
+				line.Files += ws.files.Load()
+				line.Bytes += ws.bytes.Load()
+				line.SkippedFiles += ws.skipfiles.Load()
+				line.SkippedBytes += ws.skipbytes.Load()
+				line.FreedBytes += ws.saved.Load()
+				line.Errors += ws.errors.Load()
+			}
+			if line.Elapsed > 0 {
+				// The totals include what earlier runs did, the rates are for this one
+				line.FilesPerSec = float64(line.Files-resumedfiles.Load()) / line.Elapsed
+				line.BytesPerSec = float64(line.Bytes-resumedbytes.Load()) / line.Elapsed
+			}
+			totals.add(&line, stats, now)
+			encoder.Encode(line)
+		}
+	}
+}
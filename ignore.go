@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type ignoregroup struct {
+	name        string
+	description string
+	extensions  []string
+}
+
+func ignoregroupall() []string {
+	var names []string
+	for _, group := range ignoregroups {
+		names = append(names, group.name)
+	}
+	return names
+}
+
+// ignoregroupextensions returns the extensions in the comma separated groups
+func ignoregroupextensions(names string) ([]string, error) {
+	var extensions []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "none" {
+			continue
+		}
+		found := false
+		for _, group := range ignoregroups {
+			if group.name == name {
+				extensions = append(extensions, group.extensions...)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown ignore group %q, there are %s", name, strings.Join(ignoregroupall(), ", "))
+		}
+	}
+	return extensions, nil
+}
+
+// parseignore turns a comma separated list of extensions into the suffixes
+// to match, and complains about entries that look like mistakes
+func parseignore(value string) []string {
+	suffixes := []string{}
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		// So "jpg, .png ," works the way it looks like it should
+		entry = strings.TrimSpace(entry)
+		extension := strings.ToLower(strings.TrimLeft(entry, "."))
+		if extension == "" {
+			if entry != "" {
+				logerror("Ignore list entry %q has no extension, dropping it", entry)
+			}
+			continue
+		}
+		if strings.ContainsAny(extension, " \t") {
+			logerror("Ignore list entry %q contains whitespace, it will probably never match", entry)
+		}
+		if strings.ContainsRune(extension, '/') {
+			logerror("Ignore list entry %q contains a path separator, it only matches the end of file names", entry)
+		}
+		if seen[extension] {
+			logerror("Ignore list entry %q is there more than once", entry)
+			continue
+		}
+		seen[extension] = true
+		suffixes = append(suffixes, "."+extension)
+	}
+	return suffixes
+}
+
+// How many files each ignore list entry skipped, for the summary
+var ignorecounts = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: map[string]uint64{}}
+
+func countignored(suffix string) {
+	ignorecounts.Lock()
+	ignorecounts.counts[suffix]++
+	ignorecounts.Unlock()
+}
+
+// ignoresummary lists how many files each entry in the ignore list skipped,
+// most first, and the entries that skipped nothing last
+func ignoresummary() string {
+	ignorecounts.Lock()
+	defer ignorecounts.Unlock()
+	counts := map[string]uint64{}
+	for _, suffix := range ignorelist {
+		counts[suffix] = 0
+	}
+	// Entries only from zir:ignore on some dataset are in here too
+	for suffix, n := range ignorecounts.counts {
+		counts[suffix] = n
+	}
+	suffixes := make([]string, 0, len(counts))
+	for suffix := range counts {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Slice(suffixes, func(i, j int) bool {
+		if counts[suffixes[i]] != counts[suffixes[j]] {
+			return counts[suffixes[i]] > counts[suffixes[j]]
+		}
+		return suffixes[i] < suffixes[j]
+	})
+	entries := make([]string, len(suffixes))
+	for i, suffix := range suffixes {
+		entries[i] = fmt.Sprintf("%v %s", counts[suffix], suffix)
+	}
+	return strings.Join(entries, ", ")
+}
+
+// ignoredsuffix returns the entry in the ignore list matching the file name, if any
+func ignoredsuffix(fp string) string {
+	lower := strings.ToLower(fp)
+	for _, suffix := range ignorelist {
+		if strings.HasSuffix(lower, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Files with exclude patterns for the directory they're in, read with --use-ignore-files
+var ignorefilenames = []string{".gitignore", ".zirignore"}
+
+var useignorefiles *bool
+
+// ignorefile is the patterns from one ignore file
+type ignorefile struct {
+	fp       string
+	patterns []excludepattern
+}
+
+// The ignore files found by the walk so far, by the directory they're in. Only
+// directories that have one are kept, so this stays small on big trees.
+var ignorefiles = struct {
+	sync.RWMutex
+	dirs map[string][]ignorefile
+}{dirs: map[string][]ignorefile{}}
+
+// readignorefile reads an ignore file like --exclude-from, except that lines
+// that don't parse are skipped with a warning as the file wasn't written for us
+func readignorefile(fp string) ([]excludepattern, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []excludepattern
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		p, err := parseexclude(text)
+		if err != nil {
+			log("Warning: skipping line %v of %s: %v", line, fp, err)
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, scanner.Err()
+}
+
+// loadignorefiles reads the ignore files in dir, if it has any and they weren't read yet
+func loadignorefiles(dir string) {
+	ignorefiles.RLock()
+	_, loaded := ignorefiles.dirs[dir]
+	ignorefiles.RUnlock()
+	if loaded {
+		return
+	}
+
+	var found []ignorefile
+	for _, name := range ignorefilenames {
+		fp := filepath.Join(dir, name)
+		patterns, err := readignorefile(fp)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logerror("Error reading %s, not using it: %v", fp, err)
+			}
+			continue
+		}
+		debug("Using %v patterns from %s", len(patterns), fp)
+		found = append(found, ignorefile{fp: fp, patterns: patterns})
+	}
+	if len(found) == 0 {
+		return
+	}
+	ignorefiles.Lock()
+	ignorefiles.dirs[dir] = found
+	ignorefiles.Unlock()
+}
+
+// ignorefileexcluded returns the pattern and the ignore file it's from that excludes fp,
+// going by the ignore files the walk has found in the directories above it
+func ignorefileexcluded(fp string, isdir bool) (pattern, file string) {
+	ignorefiles.RLock()
+	defer ignorefiles.RUnlock()
+	for dir := filepath.Dir(fp); ; dir = filepath.Dir(dir) {
+		for _, f := range ignorefiles.dirs[dir] {
+			rel, err := filepath.Rel(dir, fp)
+			if err != nil {
+				continue
+			}
+			if pattern := matchexcludes(f.patterns, rel, isdir); pattern != "" {
+				return pattern, f.fp
+			}
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return "", ""
+		}
+	}
+}
+
+// walkignorefiles is for the walks with --use-ignore-files: it tells if an ignore file
+// excludes fp, and reads the ignore files in fp if it is a directory that isn't excluded.
+// The walk must pass a directory before anything in it, which both walks do.
+func walkignorefiles(fp string, isdir bool) (pattern, file string) {
+	if !*useignorefiles {
+		return "", ""
+	}
+	if pattern, file = ignorefileexcluded(fp, isdir); pattern != "" {
+		return pattern, file
+	}
+	if isdir {
+		loadignorefiles(fp)
+	}
+	return "", ""
+}
+
+// explainignorefiles reads the ignore files from the current directory down to
+// the one fp is in, and tells if one of them excludes it
+func explainignorefiles(fp string) (pattern, file string) {
+	rel, err := filepath.Rel(".", fp)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ""
+	}
+	dir := "."
+	loadignorefiles(dir)
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		if pattern, file = ignorefileexcluded(dir, true); pattern != "" {
+			return pattern, file
+		}
+		loadignorefiles(dir)
+	}
+	return ignorefileexcluded(rel, false)
+}
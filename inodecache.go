@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// fileid identifies a file, inode numbers are only unique within one filesystem
+type fileid struct {
+	dev uint64
+	ino uint64
+}
+
+func statfileid(sysstat *syscall.Stat_t) fileid {
+	return fileid{uint64(sysstat.Dev), uint64(sysstat.Ino)}
+}
+
+// Number of independently locked shards, must be a power of two
+const inodecachebits = 6
+const inodecacheshards = 1 << inodecachebits
+
+// inodecache remembers which inodes have been claimed by a worker during
+// this run, so hardlinked files are only processed once. It is split into
+// shards keyed by inode hash, so lots of workers don't all fight over one lock.
+type inodecache struct {
+	shards [inodecacheshards]inodecacheshard
+}
+
+type inodecacheentries struct {
+	sync.Mutex
+	inodes map[fileid]struct{}
+}
+
+// inodecacheshard pads a shard to a whole number of cache lines, so the locks
+// of shards next to each other don't share one
+type inodecacheshard struct {
+	inodecacheentries
+	_ [(64 - unsafe.Sizeof(inodecacheentries{})%64) % 64]byte
+}
+
+func newinodecache() *inodecache {
+	ic := &inodecache{}
+	for i := range ic.shards {
+		ic.shards[i].inodes = map[fileid]struct{}{}
+	}
+	return ic
+}
+
+func (ic *inodecache) shard(id fileid) *inodecacheshard {
+	// Fibonacci hashing, so sequential inode numbers spread over all shards
+	return &ic.shards[((id.ino^id.dev)*11400714819323198485)>>(64-inodecachebits)]
+}
+
+// claim marks the inode as seen, and returns true if nobody else did so before
+func (ic *inodecache) claim(id fileid) bool {
+	s := ic.shard(id)
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.inodes[id]; found {
+		return false
+	}
+	s.inodes[id] = struct{}{}
+	return true
+}
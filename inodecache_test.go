@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+func TestInodeCacheShardCacheLines(t *testing.T) {
+	if size := unsafe.Sizeof(inodecacheshard{}); size%64 != 0 {
+		t.Errorf("inodecacheshard is %v bytes, not a whole number of cache lines", size)
+	}
+}
+
+func TestInodeCacheClaim(t *testing.T) {
+	ic := newinodecache()
+	if !ic.claim(fileid{1, 42}) {
+		t.Error("First claim of an inode failed")
+	}
+	if ic.claim(fileid{1, 42}) {
+		t.Error("Second claim of an inode succeeded")
+	}
+	if !ic.claim(fileid{2, 42}) {
+		t.Error("Claim of the same inode number on another device failed")
+	}
+}
+
+// lockedinodes is one map behind one lock, what the sharding is measured against
+type lockedinodes struct {
+	sync.Mutex
+	inodes map[fileid]struct{}
+}
+
+func (l *lockedinodes) claim(id fileid) bool {
+	l.Lock()
+	defer l.Unlock()
+	if _, found := l.inodes[id]; found {
+		return false
+	}
+	l.inodes[id] = struct{}{}
+	return true
+}
+
+// BenchmarkInodeCache claims sequential inodes from all threads at once, as the
+// workers do going through directories, each in an inode range of its own so only
+// the cache is shared. Run with -cpu 1,4,16 to see how the sharding scales against
+// a single locked map.
+func BenchmarkInodeCache(b *testing.B) {
+	for name, claim := range map[string]func() func(fileid) bool{
+		"sharded": func() func(fileid) bool { return newinodecache().claim },
+		"single-lock": func() func(fileid) bool {
+			return (&lockedinodes{inodes: map[fileid]struct{}{}}).claim
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			claim := claim()
+			var workers atomic.Uint64
+			b.RunParallel(func(pb *testing.PB) {
+				base := workers.Add(1) << 40
+				for ino := base; pb.Next(); ino++ {
+					claim(fileid{1, ino})
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+)
+
+var asklock sync.Mutex
+var askreader = bufio.NewReader(os.Stdin)
+var askall bool
+
+// stdinterminal returns true if someone can answer questions on stdin
+func stdinterminal() bool {
+	fileinfo, err := os.Stdin.Stat()
+	if err != nil || fileinfo.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// /dev/null is a character device too, but nobody is typing there
+	devnull, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fileinfo, devnull)
+}
+
+// confirm asks whether to rewrite the file, like rm -i. Answering all stops
+// the questions, quit stops the run.
+func confirm(fp string, size int64) bool {
+	asklock.Lock()
+	defer asklock.Unlock()
+	for !askall && !abort.Load() {
+		fmt.Printf("Recompress %s (%v bytes)? [y]es, [n]o, [a]ll, [q]uit: ", fp, size)
+		answer, err := askreader.ReadString('\n')
+		if err != nil {
+			// Nobody left to ask
+			log("")
+			abort.Store(true)
+			return false
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		case "a", "all":
+			askall = true
+		case "q", "quit":
+			log("Stopping, please wait for threads to finish tasks ...")
+			abort.Store(true)
+		}
+	}
+	return askall && !abort.Load()
+}
+
+// Runs estimated to rewrite more than this many bytes need --yes or a confirmation, 0 never asks
+var confirmabove uint64
+var confirmabovevalue *string // as given, for messages
+
+// confirmlarge counts what the run below root would rewrite, and asks before
+// going ahead if it's more than --confirm-above. Counting stops at the limit,
+// so small runs are counted fully but big ones don't take ages to get to the question.
+func confirmlarge(root string) error {
+	counted, err := precount(root, confirmabove, 0)
+	if err != nil {
+		return err
+	}
+	files, size := counted.files, counted.size
+	if size <= confirmabove {
+		debug("Found %v files with %v bytes to process, not asking for confirmation", files, size)
+		return nil
+	}
+
+	what := fmt.Sprintf("This would rewrite at least %v files with %s (more than --confirm-above %s)",
+		files, humanize.IBytes(size), *confirmabovevalue)
+	if !stdinterminal() {
+		return fmt.Errorf("%s, use --yes to go ahead", what)
+	}
+
+	asklock.Lock()
+	defer asklock.Unlock()
+	fmt.Printf("%s. Go ahead? [y/N]: ", what)
+	answer, _ := askreader.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errors.New("Not confirmed, nothing was changed")
+}
+
+// What precount found
+type precounted struct {
+	files, size, ondisk uint64
+	samples             []string // some of the files, picked at random
+}
+
+// precount walks root like recompress does and adds up the files that pass the
+// cheap checks, stopping once the size goes over limit. Up to samples of them
+// are picked to look at closer.
+func precount(root string, limit uint64, samples int) (counted precounted, err error) {
+	rootinfo, err := os.Stat(root)
+	if err != nil {
+		return counted, err
+	}
+	rootdev := uint64(rootinfo.Sys().(*syscall.Stat_t).Dev)
+
+	err = filepath.WalkDir(root, func(fp string, di os.DirEntry, err error) error {
+		if abort.Load() {
+			return errors.New("Aborted due to interrupt")
+		}
+		if err != nil {
+			// The real walk reports these
+			return nil
+		}
+		if fp == root && di.IsDir() {
+			walkignorefiles(fp, true)
+			return nil
+		}
+		if di.IsDir() {
+			if strings.HasPrefix(di.Name(), resumedbname) {
+				return filepath.SkipDir
+			}
+			if *onefilesystem {
+				fileinfo, err := di.Info()
+				if err == nil && uint64(fileinfo.Sys().(*syscall.Stat_t).Dev) != rootdev {
+					return filepath.SkipDir
+				}
+			}
+			if pseudofsdir(fp, di, rootdev) != "" {
+				return filepath.SkipDir
+			}
+		}
+		if len(excludes) > 0 {
+			rel, _ := filepath.Rel(root, fp)
+			if excluded(rel, di.IsDir()) != "" {
+				if di.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if pattern, _ := walkignorefiles(fp, di.IsDir()); pattern != "" {
+			if di.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !di.Type().IsRegular() || strings.HasPrefix(di.Name(), tempprefix) || ignoredsuffix(fp) != "" {
+			return nil
+		}
+		fileinfo, err := di.Info()
+		if err != nil || fileinfo.Size() <= *minfilesize {
+			return nil
+		}
+		sysstat, ok := fileinfo.Sys().(*syscall.Stat_t)
+		if ok && alreadycompressed(fileinfo, sysstat) {
+			return nil
+		}
+		counted.files++
+		counted.size += uint64(fileinfo.Size())
+		if ok {
+			counted.ondisk += uint64(sysstat.Blocks) * 512
+		}
+		if samples > 0 {
+			// Every file has the same chance to be in there, however many there turn out to be
+			if len(counted.samples) < samples {
+				counted.samples = append(counted.samples, fp)
+			} else {
+				samplelock.Lock()
+				i := sampler.Int63n(int64(counted.files))
+				samplelock.Unlock()
+				if i < int64(samples) {
+					counted.samples[i] = fp
+				}
+			}
+		}
+		if limit > 0 && counted.size > limit {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return counted, err
+}
+
+// How many files --confirm-each-dataset compresses samples of for its estimate
+const estimatefiles = 100
+
+// estimatefreed guesses how much rewriting the counted files frees, from how the
+// records sampled from some of them compress with the algorithm
+func estimatefreed(counted precounted, algorithm comparealgorithm) uint64 {
+	compress := algorithm.new()
+	buffer := make([]byte, holesize)
+	var read, alloc uint64
+	for _, fp := range counted.samples {
+		f, err := opensource(fp)
+		if err != nil {
+			continue
+		}
+		fileinfo, err := f.Stat()
+		if err == nil {
+			var r, a uint64
+			if r, _, a, err = samplerecords(f, fileinfo.Size(), buffer, compress); err == nil {
+				read += r
+				alloc += a
+			}
+		}
+		f.Close()
+	}
+	if read == 0 {
+		return 0
+	}
+	after := uint64(float64(counted.size) * float64(alloc) / float64(read))
+	if after >= counted.ondisk {
+		return 0
+	}
+	return counted.ondisk - after
+}
+
+// confirmdataset asks whether to process the dataset with --confirm-each-dataset,
+// showing what it would rewrite. Answering all stops the questions for the other
+// datasets, quit stops the run.
+func confirmdataset(ds dataset) (bool, error) {
+	if askall {
+		return true, nil
+	}
+	log("Counting what dataset %s would rewrite ...", ds.name)
+	counted, err := precount(ds.mountpoint, 0, estimatefiles)
+	if err != nil {
+		return false, err
+	}
+	// What rewriting compresses with
+	freed := estimatefreed(counted, auditalgorithm(ds.compression))
+
+	asklock.Lock()
+	defer asklock.Unlock()
+	for !abort.Load() {
+		fmt.Printf("Dataset %s (compression=%s) has %v files with %s to rewrite, using %s on disk, which could free about %s. Process it? [y]es, [n]o, [a]ll, [q]uit: ",
+			ds.name, ds.compression, counted.files, humanize.IBytes(counted.size), humanize.IBytes(counted.ondisk), humanize.IBytes(freed))
+		answer, err := askreader.ReadString('\n')
+		if err != nil {
+			log("")
+			return false, errors.New("Nobody left to ask, stopping")
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		case "a", "all":
+			askall = true
+			return true, nil
+		case "q", "quit":
+			return false, errors.New("Stopping, the other datasets were not confirmed")
+		}
+	}
+	return false, errors.New("Aborted due to interrupt")
+}
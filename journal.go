@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// mtimejournal records the modification times of rewritten files with --mtime-journal,
+// one line per file with the quoted absolute path, the original and the new mtime, and
+// the original and the new ctime. The ctime can't be set back, it is there so it's clear
+// what a backup tool looking at ctimes will see as changed.
+type mtimejournal struct {
+	sync.Mutex
+	f *os.File
+	w *bufio.Writer
+}
+
+var journal *mtimejournal
+
+func openjournal(fp string) (*mtimejournal, error) {
+	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &mtimejournal{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// record notes the file's mtime and ctime now, next to what they were before the rewrite
+func (j *mtimejournal) record(fp string, original, originalctime time.Time) error {
+	abs, err := filepath.Abs(fp)
+	if err != nil {
+		return err
+	}
+	fileinfo, err := os.Lstat(abs)
+	if err != nil {
+		return err
+	}
+	ctime := time.Now()
+	if sysstat, ok := fileinfo.Sys().(*syscall.Stat_t); ok {
+		ctime = statctime(sysstat)
+	}
+	j.Lock()
+	defer j.Unlock()
+	_, err = fmt.Fprintf(j.w, "%s\t%s\t%s\t%s\t%s\n", strconv.Quote(abs),
+		original.Format(time.RFC3339Nano), fileinfo.ModTime().Format(time.RFC3339Nano),
+		originalctime.Format(time.RFC3339Nano), ctime.Format(time.RFC3339Nano))
+	return err
+}
+
+func (j *mtimejournal) close() error {
+	if err := j.w.Flush(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// restoremtimes sets the files in a journal back to their original mtime, unless they changed since
+func restoremtimes(fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var restored, unchanged, skipped int
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		// Older journals have no ctimes, they aren't needed here anyway
+		if len(fields) != 3 && len(fields) != 5 {
+			return fmt.Errorf("%s line %v: expected path, original and new mtime, original and new ctime separated by tabs", fp, line)
+		}
+		path, err := strconv.Unquote(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s line %v: bad path: %v", fp, line, err)
+		}
+		original, err := time.Parse(time.RFC3339Nano, fields[1])
+		if err != nil {
+			return fmt.Errorf("%s line %v: bad original mtime: %v", fp, line, err)
+		}
+		rewritten, err := time.Parse(time.RFC3339Nano, fields[2])
+		if err != nil {
+			return fmt.Errorf("%s line %v: bad new mtime: %v", fp, line, err)
+		}
+
+		fileinfo, err := os.Lstat(path)
+		if err != nil {
+			logerror("Not restoring %s: %v", path, err)
+			skipped++
+			continue
+		}
+		switch {
+		case fileinfo.ModTime().Equal(original):
+			unchanged++
+		case !fileinfo.ModTime().Equal(rewritten):
+			logerror("Not restoring %s, it was modified again since", path)
+			skipped++
+		default:
+			atime := time.Now()
+			if sysstat, ok := fileinfo.Sys().(*syscall.Stat_t); ok {
+				atime = statatime(sysstat)
+			}
+			if err := os.Chtimes(path, atime, original); err != nil {
+				logerror("Failed to restore %s: %v", path, err)
+				skipped++
+				continue
+			}
+			debug("Restored mtime of %s to %v", path, original)
+			restored++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	log("Restored %v files, %v already had their original mtime, %v skipped", restored, unchanged, skipped)
+	return nil
+}
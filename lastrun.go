@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// With --since-last-run, files not modified after this are skipped. Zero means no filter.
+var lastrun time.Time
+
+// lastrunpath is where the time of the last clean run is kept, next to the resume database,
+// as that is removed when a run completes
+func lastrunpath(dbpath string) string {
+	return dbpath + "-lastrun"
+}
+
+// loadlastrun returns when the last clean run started, or the zero time if there wasn't one
+func loadlastrun(dbpath string) (time.Time, error) {
+	data, err := os.ReadFile(lastrunpath(dbpath))
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+}
+
+// savelastrun records the start of a run that got through everything. The start, not the
+// end, so files written while it was running are picked up by the next one.
+func savelastrun(dbpath string, started time.Time) error {
+	fp := lastrunpath(dbpath)
+	if err := os.WriteFile(fp+".new", []byte(started.Format(time.RFC3339Nano)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fp+".new", fp)
+}
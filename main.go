@@ -1,78 +1,184 @@
 package main
 
 import (
-	"encoding/binary"
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/pflag"
 )
 
 var totalfiles, totalbytes atomic.Uint64
 var skipfiles, skipbytes atomic.Uint64
+var walkerrors atomic.Uint64
+var fileerrors atomic.Uint64
+var savedbytes atomic.Uint64
+var notsmallerfiles atomic.Uint64
+var orphansremoved atomic.Uint64
+
+var seeninodes = newinodecache()
+
+// errnotwritable means we can read the file, but aren't allowed to change it
+var errnotwritable = errors.New("not writable")
+
+// errnotregular means the path turned into something other than a regular file after the walk saw it
+var errnotregular = errors.New("not a regular file")
+
+// errchanged means the file got a different size while it was being copied, someone else is writing to it
+var errchanged = errors.New("changed while being copied")
+
+// errbatchlimit means --batch-limit files were rewritten, and there may be more to do
+var errbatchlimit = errors.New("Batch limit reached")
+
+// errcompressionoff means compression was turned off on the dataset being processed
+var errcompressionoff = errors.New("Compression was turned off")
+
+// Exit code when stopping at --batch-limit, so a scheduler knows to run us again
+const exitmorework = 3
+
+// skippable returns true for errors that mean we should leave the file alone, not give up
+func skippable(err error) bool {
+	return errors.Is(err, errnotwritable) || errors.Is(err, errnotregular) || errors.Is(err, errchanged) || toolong(err)
+}
+
+// skiperror logs that the file is skipped for an error skippable accepts, and counts
+// a path or temporary file name that is too long with the others
+func skiperror(fp string, size int64, err error) fileresult {
+	if toolong(err) {
+		longpaths.Add(1)
+	}
+	logerror("Skipping file %s: %v", fp, err)
+	return skipped(size, err.Error())
+}
+
+// Files and directories left alone because their path is longer than the system takes
+var longpaths atomic.Uint64
+
+// toolong tells if the path, or a name in it like the temporary file's, is longer than
+// PATH_MAX or NAME_MAX. Nothing below such a directory can be opened by path.
+func toolong(err error) bool {
+	return errors.Is(err, syscall.ENAMETOOLONG)
+}
+
+// checkcopied makes sure the whole file was copied. When it wasn't, the file is looked at
+// again: if it has another size now it was truncated or appended to while we copied, and
+// is left alone, otherwise the short copy is a real error.
+func checkcopied(fp string, copied, size int64) error {
+	if copied == size {
+		return nil
+	}
+	if now, err := os.Lstat(fp); err == nil && now.Size() != size {
+		return fmt.Errorf("%w: copied %d bytes, it was %d bytes and is now %d", errchanged, copied, size, now.Size())
+	}
+	return fmt.Errorf("copied %d bytes instead of %d", copied, size)
+}
 
 var minfilesize *int64
-var debugflag, noresume *bool
-var skipratio *float64
-var ignorelist = []string{
-	// Compressed images
-	"jpg",
-	"jpeg",
-	"png",
-	"gif",
-	"webp",
-	// Compressed archive files
-	"zip",
-	"gz",
-	"bz2",
-	"xz",
-	"7z",
-	"z77",
-	"rar",
-	// Compressed video files
-	"mp4",  //
-	"avi",  //
-	"mkv",  // matroska video
-	"flv",  // flv video
-	"webm", // webm video
-	// Compressed audio files
-	"mp3",
-	"wav",
-	"ogg",
-	"flac",
-	// Other
-	"pdf",
-	"doc",
-	"docx",
-	"xls",
-	"xlsx",
-	"ppt",
-	"pptx",
-	"odt",
-	"ods",
-	"odp",
-	"odg",
-	"odf",
-	"odc",
-	"odm",
-	"odt",
-	"ncf", // netcdf
-	"deb", // debian package
+var debugflag, print0, noatime, noresume, resumememory, checksumcache, strict, keepgoing, interactive, yes, fsync, verifydataset, skipdedup, force, onlyifsmaller, sincelastrun, keeporphans, auditskips, throttle, verifycopies, safe, timing, onefilesystem, alldatasets, shuffle, confirmeachdataset *bool
+var resumedb, order, walkorder, mirrorto, outputdir, dryrun *string
+var skipratio, samplerate *float64
+var threads, buffersize *int32
+var queuesize, parallelwalkers, maxerrors, batchlimit, maxfilecount, throttleops, randomizeorder *int
 
+var checkpointinterval, heartbeatinterval, compressioncheckinterval, throttlelatency, throttleinterval *time.Duration
+
+// The walk callback can run concurrently, so the generator needs a lock
+var samplelock sync.Mutex
+var sampler *rand.Rand
+
+var abort, globalerror, errorcap, batchreached, filecountreached, compressionoff atomic.Bool
+var batchcount, enqueuedcount atomic.Uint64
+
+// The built in extensions to ignore, in groups that can be picked with --ignore-groups
+var ignoregroups = []ignoregroup{
+	{"images", "Compressed images", []string{
+		"jpg",
+		"jpeg",
+		"png",
+		"gif",
+		"webp",
+	}},
+	{"archives", "Compressed archive files", []string{
+		"zip",
+		"gz",
+		"bz2",
+		"xz",
+		"7z",
+		"z77",
+		"rar",
+		"deb", // debian package
+	}},
+	{"video", "Compressed video files", []string{
+		"mp4",  //
+		"avi",  //
+		"mkv",  // matroska video
+		"flv",  // flv video
+		"webm", // webm video
+	}},
+	{"audio", "Compressed audio files", []string{
+		"mp3",
+		"wav",
+		"ogg",
+		"flac",
+	}},
+	{"documents", "Documents, compressed on the inside", []string{
+		"pdf",
+		"doc",
+		"docx",
+		"xls",
+		"xlsx",
+		"ppt",
+		"pptx",
+		"odt",
+		"ods",
+		"odp",
+		"odg",
+		"odf",
+		"odc",
+		"odm",
+	}},
+	{"scientific", "Scientific data formats", []string{
+		"ncf", // netcdf
+	}},
 }
 
+// ignorelist is what's actually ignored, the suffixes including the dot
+var ignorelist []string
+
 func log(format string, args ...interface{}) {
-	fmt.Printf(format+"\n", args...)
+	fmt.Fprintf(logout, format+"\n", args...)
+}
+
+// Where log writes, stderr with --print0 so stdout only has the paths
+var logout io.Writer = os.Stdout
+
+// printpath writes a path the dry run would recompress for --print0, ended by a NUL
+// as file names can have newlines in them
+func printpath(fp string) {
+	fmt.Fprintf(os.Stdout, "%s\x00", fp)
+}
+
+// logerror always goes to stderr, so problems are visible even when stdout is redirected
+func logerror(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
 }
 
 func debug(format string, args ...interface{}) {
@@ -81,225 +187,1827 @@ func debug(format string, args ...interface{}) {
 	}
 }
 
-func processfile(fp string, fi os.DirEntry, db *badger.DB, buffer []byte) error {
+// alreadycompressed returns true if the file uses so few blocks compared to its size that it's not worth rewriting
+func alreadycompressed(fileinfo os.FileInfo, sysstat *syscall.Stat_t) bool {
+	return *skipratio != 0 && float64(sysstat.Blocks)*512*(*skipratio) < float64(fileinfo.Size())
+}
+
+// fileaction is what processfile ended up doing with a file
+type fileaction int
+
+const (
+	actionfailed    fileaction = iota // nothing done, see the error
+	actionskipped                     // left alone, see the reason
+	actionrewritten                   // written again, in place or by replacing it with a copy
+	actionkept                        // --only-if-smaller made a copy, but it wasn't smaller
+)
+
+// fileresult describes what happened to one file
+type fileresult struct {
+	action  fileaction
+	size    int64  // size of the file
+	copied  int64  // bytes written
+	saved   int64  // on-disk bytes freed, only known with --only-if-smaller
+	reason  string // why it was skipped
+	handled int64  // size in the resume entry it had, when done again anyway
+	inode   uint64 // for --csv, with the on-disk bytes before
+	ondisk  int64
+}
+
+func skipped(size int64, reason string) fileresult {
+	return fileresult{action: actionskipped, size: size, reason: reason}
+}
+
+func processfile(fp string, fi os.DirEntry, forced bool, db *badger.DB, buffer []byte) (fileresult, error) {
+	// The only stat of the file, the walk gets the type from the directory itself. With --order
+	// the walk has stat'ed it already, and with --prefetch the prefetcher, and that is used,
+	// possibly from hours ago: opening it checks it's still a regular file, and the copy that
+	// it didn't change size since.
 	fileinfo, err := fi.Info()
+	if toolong(err) {
+		longpaths.Add(1)
+		logerror("Skipping file %s: the path is longer than the system allows", fp)
+		return skipped(0, "path too long"), nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// Deleted or renamed since the walk saw it, nothing to do
+		debug("Skipping file %s, it is gone", fp)
+		return skipped(0, "gone"), nil
+	}
 	if err != nil {
-		return err
+		// One file that can't be stat'ed, say on a flaky mount, is no reason to stop the run
+		logerror("Skipping file %s, can't stat it: %v", fp, err)
+		return skipped(0, "can't stat it"), nil
 	}
+	size := fileinfo.Size()
 
-	if fileinfo.Size() <= *minfilesize {
+	if size <= *minfilesize && !forced {
 		debug("Skipping too small file %s", fp)
-		skipfiles.Add(1)
-		skipbytes.Add(uint64(fileinfo.Size()))
-		return nil
+		return skipped(size, "too small"), nil
 	}
 
-	for _, suffix := range ignorelist {
-		if strings.HasSuffix(strings.ToLower(fp), suffix) {
-			// Skip
-			debug("Skipping ignored file %s", fp)
-			skipfiles.Add(1)
-			skipbytes.Add(uint64(fileinfo.Size()))
-			return nil
-		}
+	if !lastrun.IsZero() && !fileinfo.ModTime().After(lastrun) && !forced {
+		debug("Skipping file %s, not modified since the last run", fp)
+		return skipped(size, "not modified since last run"), nil
+	}
+
+	if suffix := ignoredsuffix(fp); suffix != "" && !forced {
+		debug("Skipping ignored file %s", fp)
+		countignored(suffix)
+		return skipped(size, "ignored extension"), nil
 	}
 
 	sysstat, ok := fileinfo.Sys().(*syscall.Stat_t)
 	if !ok {
-		return fmt.Errorf("unknown file type %T", fileinfo.Sys())
+		return fileresult{}, fmt.Errorf("unknown file type %T", fileinfo.Sys())
+	}
+
+	if reason := wrongowner(sysstat); reason != "" {
+		debug("Skipping file %s, it is %s", fp, reason)
+		return skipped(size, "wrong owner"), nil
+	}
+
+	// The change time, as tools like rsync -t set the modification time back
+	if !snapshotcutoff.IsZero() && statctime(sysstat).After(snapshotcutoff) && !forced {
+		debug("Skipping file %s, changed after the latest snapshot", fp)
+		return skipped(size, "newer than latest snapshot"), nil
+	}
+
+	// Hardlinked files show up once per link, only handle the first one we see
+	id := statfileid(sysstat)
+	if sysstat.Nlink > 1 && !seeninodes.claim(id) {
+		debug("Skipping already seen hardlink %s", fp)
+		return skipped(size, "hardlink already seen"), nil
 	}
 
 	// See if the inode has been handled already
-	var skip bool
-	if db != nil {
-		err = db.View(func(txn *badger.Txn) error {
-			b := make([]byte, 8)
-			binary.LittleEndian.PutUint64(b, uint64(sysstat.Ino))
-			item, err := txn.Get(b)
-			if err == nil {
-				err = item.Value(func(val []byte) error {
-					if string(val) == "handled" {
-						debug("Skipping handled file %s", fp)
-						skipfiles.Add(1)
-						skipbytes.Add(uint64(fileinfo.Size()))
-						skip = true
-					}
-					return nil
-				})
+	var recompressed, handled int64
+	if db != nil && !forced {
+		entry, found, err := resumeget(db, id)
+		if err != nil {
+			return fileresult{}, err
+		}
+		if found {
+			recompressed = entry.recompressed
+			handled = entry.size
+		}
+		if found && !stale(fileinfo, recompressed) {
+			if entry.matches(fileinfo) {
+				debug("Skipping handled file %s", fp)
+				return skipped(size, "already handled"), nil
 			}
-			if err == badger.ErrKeyNotFound {
-				return nil
+			if *checksumcache && entry.hash != nil {
+				// Metadata changed, but maybe the contents didn't
+				hash, err := hashfile(fp, buffer)
+				if skippable(err) {
+					return skiperror(fp, size, err), nil
+				}
+				if err != nil {
+					return fileresult{}, err
+				}
+				if bytes.Equal(hash, entry.hash) {
+					debug("Skipping handled file %s with unchanged contents", fp)
+					if *dryrun == "on" {
+						return skipped(size, "already handled, contents unchanged"), nil
+					}
+					return skipped(size, "already handled, contents unchanged"), resumeput(db, id, resumeentry{
+						size:         size,
+						mtime:        fileinfo.ModTime().UnixNano(),
+						recompressed: entry.recompressed,
+						action:       entry.action,
+						hash:         hash,
+					})
+				}
 			}
-			return err
-		})
+		}
 	}
-	if err != nil {
-		return err
+
+	due := stale(fileinfo, recompressed)
+	if due {
+		debug("File %s was last written %v, rewriting it with --rewrite-older-than", fp, lastwritten(fileinfo, recompressed).Format(time.RFC3339))
 	}
-	if skip {
-		return nil
+
+	if *skipminimal && !forced && minimalondisk(size, sysstat.Blocks*512) {
+		debug("Skipping file %s, %v bytes in %v bytes is a single sector already", fp, size, sysstat.Blocks*512)
+		minimalfiles.Add(1)
+		return skipped(size, "minimal on disk already"), nil
+	}
+
+	verdict := zdbunknown
+	if *zdbcheck && !forced && !due {
+		var detail string
+		verdict, detail = zdbcheckfile(fp, sysstat)
+		switch verdict {
+		case zdbdone:
+			debug("Skipping file %s, zdb shows %s", fp, detail)
+			return skipped(size, "stored with the dataset's algorithm already"), nil
+		case zdbdue:
+			debug("File %s needs rewriting, zdb shows %s", fp, detail)
+		}
 	}
 
-	if *skipratio != 0 && float64(sysstat.Blocks)*512*(*skipratio) < float64(fileinfo.Size()) { // If file is already compressed 1.2:1 then skip it
+	if alreadycompressed(fileinfo, sysstat) && !forced && !due && verdict != zdbdue {
 		// Already compressed or sparse, skip
 		debug("Skipping already compressed or sparse file %s", fp)
-		skipfiles.Add(1)
-		skipbytes.Add(uint64(fileinfo.Size()))
-		return nil
+		if *auditskips {
+			auditskip(fp, size, sysstat.Blocks*512, buffer)
+		}
+		return skipped(size, "already compressed or sparse"), nil
 	}
 
-	if fileinfo.Size() == 0 {
+	if size == 0 {
 		debug("Skipping zero bytes file %s", fp)
-		skipfiles.Add(1)
-		skipbytes.Add(uint64(fileinfo.Size()))
-		return nil
+		return skipped(size, "empty"), nil
+	}
+
+	if *onlyifsmaller && sysstat.Nlink > 1 {
+		// Renaming a copy into place would split it from its other links
+		debug("Skipping hardlinked file %s, it can't be replaced by a copy", fp)
+		return skipped(size, "hardlinked, can't be replaced by a copy"), nil
+	}
+
+	// Last as it reads the file, so it's only done when nothing else skips it
+	if len(mimepatterns) > 0 && !forced {
+		mediatype, err := sniffmime(fp, buffer)
+		if skippable(err) {
+			return skiperror(fp, size, err), nil
+		}
+		if err != nil {
+			return fileresult{}, err
+		}
+		if !mimewanted(mediatype) {
+			debug("Skipping file %s, it looks like %s", fp, mediatype)
+			mimeskipped.Add(1)
+			return skipped(size, "type not wanted by --mime"), nil
+		}
+	}
+
+	if *interactive && !*yes && !confirm(fp, size) {
+		return skipped(size, "declined"), nil
+	}
+
+	if !reservebatch() {
+		// Left for the next run
+		debug("Skipping file %s, --batch-limit reached", fp)
+		return skipped(size, "batch limit reached"), nil
+	}
+
+	if *dryrun != "" {
+		if *print0 {
+			printpath(fp)
+		} else {
+			log("Would recompress %s with size %v bytes (uses %v bytes)", fp, size, sysstat.Blocks*512)
+		}
+		result := fileresult{action: actionrewritten, size: size, handled: handled, inode: uint64(sysstat.Ino), ondisk: int64(sysstat.Blocks) * 512}
+		if *dryrun == "resume" && db != nil {
+			// Just like a real run would, but in the throwaway database
+			err = resumeput(db, id, resumeentry{
+				size:         size,
+				mtime:        fileinfo.ModTime().UnixNano(),
+				recompressed: time.Now().UnixNano(),
+				action:       actionrewritten,
+			})
+		}
+		return result, err
 	}
 
+	// Copies need room next to the original until they replace it
+	var need int64
+	if *onlyifsmaller || *mirrorto != "" {
+		need = size
+	}
+	if !freespace.reserve(fp, need) {
+		return skipped(size, "not enough free space"), nil
+	}
+	defer freespace.release(need)
+
 	// Process the file
-	debug("Processing file %s with size %v bytes (uses %v bytes)", fp, fileinfo.Size(), sysstat.Blocks*512)
+	debug("Processing file %s with size %v bytes (uses %v bytes)", fp, size, sysstat.Blocks*512)
+
+	var hasher hash.Hash
+	if (db != nil && *checksumcache) || *treechecksum {
+		hasher = sha256.New()
+	}
+
+	result := fileresult{action: actionrewritten, size: size, copied: size, handled: handled, inode: uint64(sysstat.Ino), ondisk: int64(sysstat.Blocks) * 512}
+	if *mirrorto != "" {
+		err = mirrorfile(fp, fileinfo, sysstat, buffer, hasher)
+		if skippable(err) {
+			return skiperror(fp, size, err), nil
+		}
+		if err != nil {
+			return fileresult{}, err
+		}
+		pendsavings(fp, filepath.Join(*mirrorto, fp), uint64(size), int64(sysstat.Blocks)*512)
+	} else if *onlyifsmaller {
+		var smaller bool
+		var ondisk int64
+		id, ondisk, smaller, err = rewritetemp(fp, fileinfo, sysstat, buffer, hasher)
+		if skippable(err) {
+			return skiperror(fp, size, err), nil
+		}
+		if err != nil {
+			return fileresult{}, err
+		}
+		result.saved = int64(sysstat.Blocks)*512 - ondisk
+		if !smaller {
+			// Counted as freeing nothing, that's what the extension gets out of it
+			ondisk = int64(sysstat.Blocks) * 512
+		}
+		countsavings(fp, uint64(size), int64(sysstat.Blocks)*512, ondisk)
+		if !smaller {
+			debug("Keeping original file %s, recompressed copy was not smaller", fp)
+			result.action = actionkept
+			result.saved = 0
+			if *treechecksum {
+				addtreefile(fp, fp, hasher.Sum(nil))
+			}
+			if db != nil {
+				// Tried, so --rewrite-older-than doesn't try again right away
+				err = resumeput(db, id, resumeentry{
+					size:         size,
+					mtime:        fileinfo.ModTime().UnixNano(),
+					recompressed: time.Now().UnixNano(),
+					action:       actionkept,
+				})
+			}
+			return result, err
+		}
+	} else {
+		err = rewriteinplace(fp, fileinfo, sysstat, buffer, hasher)
+		if skippable(err) {
+			return skiperror(fp, size, err), nil
+		}
+		if err != nil {
+			return fileresult{}, err
+		}
+		pendsavings(fp, fp, uint64(size), int64(sysstat.Blocks)*512)
+	}
+
+	written := fp
+	if *mirrorto != "" {
+		written = filepath.Join(*mirrorto, fp)
+	}
+	if *treechecksum {
+		addtreefile(fp, written, hasher.Sum(nil))
+	}
+	if journal != nil {
+		if err := journal.record(written, fileinfo.ModTime(), statctime(sysstat)); err != nil {
+			logerror("Failed to write the mtime journal for %s: %v", fp, err)
+		}
+	}
+
+	// Remember that we handled this inode
+	if db != nil {
+		entry := resumeentry{
+			size:         size,
+			mtime:        fileinfo.ModTime().UnixNano(),
+			recompressed: time.Now().UnixNano(),
+			action:       actionrewritten,
+		}
+		if *checksumcache {
+			entry.hash = hasher.Sum(nil)
+		}
+		err = resumeput(db, id, entry)
+	}
 
-	source, err := os.Open(fp)
+	return result, err
+}
+
+// rewriteinplace reads and writes the file at the same time, so every block is written again
+func rewriteinplace(fp string, fileinfo os.FileInfo, sysstat *syscall.Stat_t, buffer []byte, hasher hash.Hash) error {
+	defer timed(&copytime, time.Now())
+	source, err := opensource(fp)
 	if err != nil {
 		return err
 	}
-	target, err := os.OpenFile(fp, os.O_RDWR, 0)
+	defer source.Close()
+	target, err := opennofollow(fp, os.O_RDWR|syscall.O_NONBLOCK)
 	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return fmt.Errorf("%w: %v", errnotwritable, err)
+		}
+		return err
+	}
+	// Closing twice is harmless, this catches the error paths
+	defer target.Close()
+	if err = checkregular(target); err != nil {
 		return err
 	}
-	// Copy from source to target
-	copied, err := io.CopyBuffer(target, source, buffer)
+
+	// Copy from source to target in whole records, so ZFS doesn't have to read any
+	// back to change part of them. Zeroes are written too, as skipping them
+	// would keep the old blocks - ZFS turns them into holes when compressing.
+	// A read interrupted by a signal like Ctrl-C is retried by copyrecords.
+	var w io.Writer = target
+	if hasher != nil {
+		w = io.MultiWriter(target, hasher)
+	}
+	copied, err := copyrecords(w, source, buffer)
 	if err != nil {
 		return err
 	}
-	target.Close()
-	source.Close()
+	if *fsync {
+		if err = target.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = target.Close(); err != nil {
+		return err
+	}
+
+	if err = checkcopied(fp, copied, sysstat.Size); err != nil {
+		return err
+	}
+
+	// Set the timestamps back to the original
+	return os.Chtimes(fp, statatime(sysstat), fileinfo.ModTime())
+}
+
+// opensource opens the file for reading, with --noatime without touching its access time if we're allowed to.
+// Fails with errnotregular if what got opened isn't a regular file.
+func opensource(fp string) (*os.File, error) {
+	// Non blocking, so a FIFO that took the place of a file doesn't hang us
+	flags := os.O_RDONLY | syscall.O_NONBLOCK
+	if *noatime && onoatime != 0 {
+		f, err := opennofollow(fp, flags|onoatime)
+		if !errors.Is(err, fs.ErrPermission) {
+			return regularonly(f, err)
+		}
+		// Only the owner or root may do that, so just open it normally
+	}
+	return regularonly(opennofollow(fp, flags))
+}
 
-	if copied != sysstat.Size {
-		return fmt.Errorf("copied %d bytes instead of %d", copied, sysstat.Size)
+// opennofollow opens the file, but not a symlink that took its place since the walk
+// saw it: that fails with errnotregular like anything else that isn't a regular file.
+// Linux says ELOOP for a symlink, FreeBSD EMLINK.
+func opennofollow(fp string, flags int) (*os.File, error) {
+	f, err := os.OpenFile(fp, flags|syscall.O_NOFOLLOW, 0)
+	if errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.EMLINK) {
+		return nil, fmt.Errorf("%w: %s is a symlink", errnotregular, fp)
 	}
+	return f, err
+}
 
-	// Set the last modified timestamp to the original
-	err = os.Chtimes(fp, fileinfo.ModTime(), fileinfo.ModTime())
+// regularonly passes on the opened file if it is a regular file, and closes it otherwise
+func regularonly(f *os.File, err error) (*os.File, error) {
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err = checkregular(f); err != nil {
+		f.Close()
+		return nil, err
 	}
+	return f, nil
+}
 
-	// Start a write transaction.
-	if db != nil {
-		err = db.Update(func(txn *badger.Txn) error {
-			// Set the key-value pair in the database.
-			b := make([]byte, 8)
-			binary.LittleEndian.PutUint64(b, uint64(sysstat.Ino))
-			err := txn.Set(b, []byte("handled"))
-			return err
-		})
+// checkregular makes sure the open file is still a regular file, the walk
+// only saw the path and something else could have been put there since
+func checkregular(f *os.File) error {
+	fileinfo, err := f.Stat()
+	if err != nil {
+		return err
 	}
+	if !fileinfo.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is %v", errnotregular, f.Name(), fileinfo.Mode().Type())
+	}
+	return nil
+}
 
-	totalfiles.Add(1)
-	totalbytes.Add(uint64(fileinfo.Size()))
+const resumedbname = ".zfs-inplace-recompress-resume"
 
-	return err
+// Warn when collecting this many files for --order or --shuffle
+const collectwarning = 10000000
+
+type queueItem struct {
+	fp     string
+	fi     os.DirEntry
+	info   os.FileInfo // only looked up in the walk when needed for --order
+	forced bool        // named on the command line with --force, so the skip checks don't apply
 }
 
-func main() {
-	ignore := pflag.String("ignore", strings.Join(ignorelist, ","), "Ignore files with these extensions")
-	debugflag = pflag.Bool("debug", false, "Debug mode")
-	noresume = pflag.Bool("noresume", false, "Dont create or use the resume database")
-	skipratio = pflag.Float64("skipratio", 1.5, "Skip files that are already compressed more than this ratio (1.5:1 default, 0 = dont skip)")
-	minfilesize = pflag.Int64("minfilesize", 16384, "Minimum filesize to process")
-	threads := pflag.Int32("threads", int32(runtime.NumCPU()*2), "Number of parallel file IO threads")
-	buffersize := pflag.Int32("buffersize", 16*1024*1024, "Buffer size per thread for IO")
-	pflag.Parse()
+// lookup stats the file when --order sorts on what that tells
+func (item *queueItem) lookup() {
+	if *order != "mtime" && *order != "size-desc" {
+		return
+	}
+	info, err := item.fi.Info()
+	if err != nil {
+		logerror("Error getting info for %s, not ordering it: %v", item.fp, err)
+	}
+	item.info = info
+}
+
+// entry is what processfile gets for the item, with what the walk looked up
+// already so the file isn't stat'ed twice
+func (item queueItem) entry() os.DirEntry {
+	if item.info != nil {
+		return fs.FileInfoToDirEntry(item.info)
+	}
+	return item.fi
+}
+
+// outputpath returns where to write the --csv or --mtime-journal file given as fp,
+// a relative path is in --output-dir when that's set
+func outputpath(fp string) string {
+	if *outputdir == "" || filepath.IsAbs(fp) {
+		return fp
+	}
+	return filepath.Join(*outputdir, fp)
+}
 
-	ignorelist = []string{}
-	for _, pattern := range strings.Split(*ignore, ",") {
-		ignorelist = append(ignorelist, "."+strings.ToLower(pattern))
+// resumedbpath returns where to keep the resume database, for a run in root
+// of the named dataset (empty if not running per dataset)
+func resumedbpath(root, datasetname string) string {
+	switch {
+	case *resumememory:
+		return ""
+	case *resumedb == "" && *outputdir != "" && datasetname != "":
+		return filepath.Join(*outputdir, resumedbname+"-"+strings.ReplaceAll(datasetname, "/", "_"))
+	case *resumedb == "" && *outputdir != "":
+		return filepath.Join(*outputdir, resumedbname)
+	case *resumedb == "" && *mirrorto != "":
+		// It's about the copies, so it goes with them
+		return filepath.Join(*mirrorto, resumedbname)
+	case *resumedb == "":
+		return filepath.Join(root, resumedbname)
+	case datasetname != "":
+		return filepath.Join(*resumedb, strings.ReplaceAll(datasetname, "/", "_"))
 	}
+	return *resumedb
+}
 
+// recompress processes everything below root, keeping its resume database in dbpath
+func recompress(root, dbpath string) error {
 	var db *badger.DB
 	var err error
 
-	if !*noresume {
-		opts := badger.DefaultOptions(".zfs-inplace-recompress-resume")
-		db, err = badger.Open(opts)
+	// One for each worker, merged into the totals once they are done
+	stats := startstats(int(*threads))
+
+	// Saving progress has to stop before the database is closed
+	var checkpoints sync.WaitGroup
+	stopcheckpoint := make(chan struct{})
+	stopcheckpoints := func() {
+		if stopcheckpoint != nil {
+			close(stopcheckpoint)
+			stopcheckpoint = nil
+			checkpoints.Wait()
+		}
+	}
+
+	rootinfo, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	rootdev := uint64(rootinfo.Sys().(*syscall.Stat_t).Dev)
+	warnpseudofs(root)
+	freespace = watchfreespace(root)
+	stopmountwatch := watchmount(root, rootdev)
+	defer stopmountwatch()
+
+	setupzdb(root, rootdev)
+
+	// With --confirm-each-dataset the question about the dataset said it all
+	if confirmabove > 0 && !*yes && *dryrun == "" && !*confirmeachdataset {
+		if err := confirmlarge(root); err != nil {
+			return err
+		}
+	}
+
+	// Files not modified since the last clean run of this job are left alone
+	statepath := dbpath
+	started := time.Now()
+	lastrun = time.Time{}
+	if *sincelastrun && statepath != "" {
+		lastrun, err = loadlastrun(statepath)
 		if err != nil {
-			log("Failed to open Badger resume database: %v", err)
-			os.Exit(1)
+			return fmt.Errorf("Failed to read the time of the last run: %w", err)
+		}
+		if lastrun.IsZero() {
+			log("No earlier run to continue from, processing all files")
+		} else {
+			log("Only processing files modified since the last run at %v", lastrun.Format(time.RFC3339))
 		}
 	}
 
-	type queueItem struct {
-		fp string
-		fi os.DirEntry
+	// A plain dry run only looks at the resume database, --dry-run=resume plays
+	// with one of its own next to it, which is thrown away when done just the same
+	readonly := *dryrun == "on"
+	if *dryrun == "resume" && dbpath != "" {
+		dbpath += "-dryrun"
+	}
+	if readonly && dbpath != "" {
+		if _, err := os.Stat(dbpath); err != nil {
+			// Nothing to look at, an empty one in memory does the same
+			dbpath = ""
+		}
 	}
 
-	filequeue := make(chan queueItem, *threads)
+	if !*noresume {
+		db, err = openresume(dbpath, readonly && dbpath != "")
+		if toomanyfiles(err) {
+			return fmt.Errorf("Failed to open Badger resume database, it uses a file descriptor per table and ran out of them (%s): %w", filelimithint(err), err)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to open Badger resume database: %w", err)
+		}
+		// Carry on counting from where earlier runs of this job got to
+		base := currentprogress()
+		earlier, err := loadprogress(db)
+		if err != nil {
+			return fmt.Errorf("Failed to read progress from resume database: %w", err)
+		}
+		if earlier.files > 0 || earlier.notsmaller > 0 {
+			log("Resuming, earlier runs processed %v files, %v bytes", earlier.files, earlier.bytes)
+			earlier.addtototals()
+		}
+		if *checkpointinterval > 0 && !readonly {
+			checkpoints.Add(1)
+			go func(stop <-chan struct{}) {
+				checkpoint(db, base, func() progress { return liveprogress(stats) }, *checkpointinterval, stop)
+				checkpoints.Done()
+			}(stopcheckpoint)
+		}
+
+		// Whichever way we leave, the database must be closed to be consistent
+		defer func() {
+			stopcheckpoints()
+			if db != nil && !readonly {
+				if err := saveprogress(db, currentprogress().minus(base)); err != nil {
+					logerror("Failed to save progress to the resume database: %v", err)
+				}
+			}
+			if db != nil {
+				if err := db.Close(); err != nil {
+					logerror("Failed to close resume database: %v", err)
+				}
+			}
+		}()
+		if !readonly {
+			migrated, err := migrateresume(db, rootdev)
+			if err != nil {
+				return fmt.Errorf("Failed to migrate resume database: %w", err)
+			}
+			if migrated > 0 {
+				log("Migrated %v entries in the resume database to the new format", migrated)
+			}
+		} else if _, err := resumeformat(db); err != nil {
+			return fmt.Errorf("Can't use resume database: %w", err)
+		}
+	}
 
-	var abort bool
+	filequeue := make(chan queueItem, *queuesize)
+	errorsbefore := fileerrors.Load()
+	walkerrorsbefore := walkerrors.Load()
+	var rewritten rewrittenfiles
 
-	// Ctrl-C handler to set abort
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		<-c
-		log("Terminating, please wait for threads to finish tasks ...")
-		abort = true
-	}()
+	stopheartbeats := func() {}
+	if *heartbeatinterval > 0 {
+		var totals *heartbeattotals
+		if *heartbeattotal {
+			totals = starttotals(root, db)
+		}
+		stopheartbeat := make(chan struct{})
+		var heartbeats sync.WaitGroup
+		heartbeats.Add(1)
+		go func() {
+			heartbeat(stats, filequeue, *heartbeatinterval, totals, stopheartbeat)
+			heartbeats.Done()
+		}()
+		stopheartbeats = func() {
+			if stopheartbeat != nil {
+				close(stopheartbeat)
+				stopheartbeat = nil
+				heartbeats.Wait()
+			}
+		}
+		defer stopheartbeats()
+	}
+
+	// With --throttle fewer workers get to go when the pool is busy, with
+	// --parallelism auto as many as get the most through
+	var gate *workergate
+	if *throttle {
+		var stopthrottle func()
+		gate, stopthrottle = startthrottle(root)
+		defer stopthrottle()
+	} else if *parallelism == "auto" {
+		var stopautotune func()
+		gate, stopautotune = startautotune()
+		defer stopautotune()
+	} else if *keepgoing {
+		// Only there to let fewer go when out of file descriptors
+		gate = newworkergate(int(*threads))
+	}
+
+	// With --prefetch the workers get the files from the prefetcher, after it
+	// asked for them to be read. A dry run doesn't read them.
+	var workqueue <-chan queueItem = filequeue
+	if *prefetch > 0 && *dryrun == "" {
+		workqueue = startprefetch(filequeue, *prefetch, db)
+	}
 
-	var globalerror bool
 	var workers sync.WaitGroup
-	for i := 0; i < runtime.NumCPU(); i++ {
+	for i := 0; i < int(*threads); i++ {
 		workers.Add(1)
-		go func() {
-			buffer := make([]byte, *buffersize)
-			for item := range filequeue {
-				err := processfile(item.fp, item.fi, db, buffer)
+		go func(ws *workerstats) {
+			buffer := recordbuffer(*buffersize)
+			for item := range workqueue {
+				if fsunavailable.Load() {
+					// Everything left would fail the same way
+					continue
+				}
+				gate.enter()
+				inflight.Add(1)
+				began := time.Now()
+				result, err := processfile(item.fp, item.entry(), item.forced, db, buffer)
+				took := time.Since(began)
+				inflight.Add(-1)
+				gate.leave()
+				if csvout != nil {
+					if err := csvout.record(item.fp, result, took, err); err != nil {
+						logerror("Failed to write the --csv row for %s: %v", item.fp, err)
+					}
+				}
+				ws.count(result)
+				if *verifydataset && result.action == actionrewritten {
+					if *mirrorto != "" {
+						rewritten.add(filepath.Join(*mirrorto, item.fp))
+					} else {
+						rewritten.add(item.fp)
+					}
+				}
+				if checkfsgone(root, rootdev, err) {
+					continue
+				}
 				if err != nil {
 					log("Error processing file %s: %v", item.fp, err)
-					globalerror = true
+					if toomanyfiles(err) {
+						outoffiles(err, gate)
+					}
+					ws.errors.Add(1)
+					if !*keepgoing {
+						ws.failed.Store(true)
+					}
+					checkerrorcap()
 				}
 			}
 			workers.Done()
-		}()
+		}(&stats[i])
 	}
 
-	err = filepath.WalkDir(".", func(fp string, di os.DirEntry, err error) error {
-		if globalerror {
-			return errors.New("Aborted due to global error")
+	// With --shuffle or --order everything is collected first, and fed to the workers after the walk
+	collecting := *shuffle || *order != ""
+	var collected []queueItem
+	var collectlock sync.Mutex
+	var window *reorderwindow
+	if *randomizeorder > 0 && !collecting {
+		window = &reorderwindow{size: *randomizeorder}
+	}
+	enqueue := func(item queueItem) {
+		if collecting {
+			item.lookup()
+			collectlock.Lock()
+			collected = append(collected, item)
+			if len(collected) == collectwarning {
+				logerror("Found %v files so far, keeping them all in memory for --order or --shuffle is getting expensive", len(collected))
+			}
+			collectlock.Unlock()
+			return
 		}
-		if abort {
-			return errors.New("Aborted due to interrupt")
+		if window != nil {
+			var ok bool
+			if item, ok = window.add(item); !ok {
+				return
+			}
+		}
+		filequeue <- item
+	}
+
+	// The mirror may well be below root
+	var mirrorinfo, outputinfo os.FileInfo
+	if *mirrorto != "" {
+		mirrorinfo, _ = os.Stat(*mirrorto)
+	}
+	if *outputdir != "" {
+		outputinfo, _ = os.Stat(*outputdir)
+	}
+
+	walkfn := func(fp string, di os.DirEntry, err error) error {
+		if err := stopped(); err != nil {
+			return err
 		}
 
 		if err != nil {
-			log("Error walking directory: %v", err)
+			if checkfsgone(root, rootdev, err) {
+				return errfsunavailable
+			}
+			walkerrors.Add(1)
+			checkerrorcap()
+			if fp == root || *strict {
+				// Can't even start, or we were asked not to tolerate holes in the walk
+				return err
+			}
+			if toolong(err) {
+				longpaths.Add(1)
+				logerror("Skipping %s and everything below it, the path is longer than the system allows", fp)
+			} else if di != nil && di.IsDir() {
+				logerror("Error reading directory %s, skipping everything below it: %v", fp, err)
+			} else {
+				logerror("Error walking %s, skipping it: %v", fp, err)
+			}
 			return nil // but continue walking elsewhere
 		}
 
-		if di.Type().IsRegular() {
-			// Find the file inode
-			filequeue <- queueItem{fp, di}
+		if *onefilesystem && di.IsDir() && fp != root {
+			fileinfo, err := di.Info()
+			if err == nil && uint64(fileinfo.Sys().(*syscall.Stat_t).Dev) != rootdev {
+				debug("Not descending into %s, it is on another filesystem", fp)
+				return filepath.SkipDir
+			}
 		}
-		return nil
-	})
+
+		if fp != root {
+			if name := pseudofsdir(fp, di, rootdev); name != "" {
+				log("Not descending into %s, it is a %s filesystem", fp, name)
+				return filepath.SkipDir
+			}
+		}
+
+		if strings.HasPrefix(di.Name(), resumedbname) {
+			// Our own bookkeeping, or that of another run
+			if di.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if (mirrorinfo != nil || outputinfo != nil) && di.IsDir() {
+			if fileinfo, err := di.Info(); err == nil {
+				if mirrorinfo != nil && os.SameFile(fileinfo, mirrorinfo) {
+					debug("Not descending into the mirror directory %s", fp)
+					return filepath.SkipDir
+				}
+				if outputinfo != nil && os.SameFile(fileinfo, outputinfo) {
+					// The CSV file and the mtime journal change while we go
+					debug("Not descending into the output directory %s", fp)
+					return filepath.SkipDir
+				}
+			}
+		}
+
+		if len(excludes) > 0 && fp != root {
+			rel, _ := filepath.Rel(root, fp)
+			if pattern := excluded(rel, di.IsDir()); pattern != "" {
+				debug("Excluding %s, it matches %s", fp, pattern)
+				if di.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if pattern, file := walkignorefiles(fp, di.IsDir()); pattern != "" {
+			debug("Excluding %s, it matches %s in %s", fp, pattern, file)
+			if di.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if di.Type().IsRegular() {
+			if strings.HasPrefix(di.Name(), tempprefix) {
+				// One of ours, in the middle of being written or left behind by a run that crashed
+				removeorphan(fp, di)
+				return nil
+			}
+			if *samplerate < 1 {
+				samplelock.Lock()
+				picked := sampler.Float64() < *samplerate
+				samplelock.Unlock()
+				if !picked {
+					debug("Skipping file %s not picked by sampling", fp)
+					return nil
+				}
+			}
+			if !reservefilecount() {
+				return filepath.SkipAll
+			}
+			enqueue(queueItem{fp: fp, fi: di, forced: *force && fp == root})
+		}
+		return nil
+	}
+
+	// This includes waiting for the workers when the queue is full
+	walkstart := time.Now()
+	if *parallelwalkers > 0 {
+		err = parallelwalk(root, *parallelwalkers, walkfn)
+	} else if *walkorder != "lexical" {
+		err = orderedwalk(root, *walkorder == "breadth-first", walkfn)
+	} else {
+		err = filepath.WalkDir(root, walkfn)
+	}
+	timed(&walktime, walkstart)
+
+	if err == nil && collecting {
+		if *shuffle {
+			log("Found %v files, processing them in random order", len(collected))
+			samplelock.Lock()
+			sampler.Shuffle(len(collected), func(i, j int) {
+				collected[i], collected[j] = collected[j], collected[i]
+			})
+			samplelock.Unlock()
+		} else {
+			log("Found %v files, processing them ordered by %s", len(collected), *order)
+			sortqueue(collected, *order)
+		}
+		for _, item := range collected {
+			if err = stopped(); err != nil {
+				break
+			}
+			filequeue <- item
+		}
+	}
+	if err == nil && window != nil {
+		for _, item := range window.drain() {
+			if err = stopped(); err != nil {
+				break
+			}
+			filequeue <- item
+		}
+	}
 
 	close(filequeue)
 	workers.Wait()
+	// These add the worker stats to the totals themselves
+	stopcheckpoints()
+	stopheartbeats()
+	mergestats(stats)
 
+	if err != nil {
+		return fmt.Errorf("Error walking directory: %w", err)
+	}
+	if err = stopped(); err != nil {
+		// A worker gave up after the walk was done
+		return err
+	}
+	if *verifydataset && *dryrun == "" {
+		if failed := verifyfiles(rewritten.paths); failed > 0 {
+			return fmt.Errorf("%v of %v rewritten files could not be read back", failed, len(rewritten.paths))
+		}
+		log("All %v rewritten files read back fine", len(rewritten.paths))
+	}
+	if fileerrors.Load() > errorsbefore {
+		// Keep the resume database, so the next run only retries the files that failed
+		log("Keeping the resume database, as %v files could not be processed", fileerrors.Load()-errorsbefore)
+		return nil
+	}
+	if filecountreached.Load() {
+		// Not everything was looked at, the next run shouldn't redo what was
+		if db != nil && !readonly && *dryrun == "" {
+			log("Keeping the resume database, as --max-file-count stopped the walk")
+		}
+		return nil
+	}
 	if db != nil {
-		db.Close()
+		stopcheckpoints()
+		persistent := *persistentresume && dbpath != "" && !readonly
+		remembering := *rewriteolderthan > 0 && dbpath != "" && !readonly && *dryrun == ""
+		if persistent || remembering {
+			// The job is done, the next run starts counting a new one
+			if err := clearprogress(db); err != nil {
+				logerror("Failed to reset progress in the resume database: %v", err)
+			}
+		}
+		closeerr := db.Close()
+		db = nil
+		if closeerr != nil {
+			return fmt.Errorf("Failed to close resume database: %w", closeerr)
+		}
+		if persistent {
+			debug("Keeping the resume database %s for the next run, as asked with --persistent-resume", dbpath)
+		} else if remembering {
+			log("Keeping the resume database, --rewrite-older-than uses it to remember when files were recompressed")
+		} else if dbpath != "" && !readonly {
+			os.RemoveAll(dbpath)
+		}
+	}
+	if *sincelastrun && statepath != "" && *dryrun == "" {
+		if walkerrors.Load() > walkerrorsbefore {
+			// Files in the parts that couldn't be read would never be picked up
+			log("Not updating the time of the last run, as parts of the tree could not be read")
+		} else if err := savelastrun(statepath, started); err != nil {
+			return fmt.Errorf("Failed to save the time of the last run: %w", err)
+		}
 	}
+	return nil
+}
 
-	log("Processed %v files, %v bytes", totalfiles.Load(), totalbytes.Load())
-	log("Skipped %v files, %v bytes", skipfiles.Load(), skipbytes.Load())
+// checkerrorcap stops the run once --max-errors is reached, even with --keep-going
+func checkerrorcap() {
+	running, _ := runningerrors()
+	if *maxerrors > 0 && fileerrors.Load()+running+walkerrors.Load() >= uint64(*maxerrors) && !errorcap.Swap(true) {
+		globalerror.Store(true)
+	}
+}
+
+// reservebatch counts a file towards --batch-limit, and returns false if there's no room left.
+// The run only stops once a file is turned away, so doing exactly the last files of the
+// tree in a batch doesn't say there's more to do.
+func reservebatch() bool {
+	if *batchlimit == 0 {
+		return true
+	}
+	if batchcount.Add(1) > uint64(*batchlimit) {
+		batchreached.Store(true)
+		return false
+	}
+	return true
+}
 
+// reservefilecount counts a file towards --max-file-count, and returns false once that many were queued
+func reservefilecount() bool {
+	if *maxfilecount == 0 {
+		return true
+	}
+	if enqueuedcount.Add(1) > uint64(*maxfilecount) {
+		filecountreached.Store(true)
+		return false
+	}
+	return true
+}
+
+// stopped returns why the run should stop, or nil if it should carry on
+func stopped() error {
+	if fsunavailable.Load() {
+		return errfsunavailable
+	}
+	if errorcap.Load() {
+		return fmt.Errorf("Aborted after reaching the limit of %v errors set with --max-errors", *maxerrors)
+	}
+	if _, failed := runningerrors(); failed || globalerror.Load() {
+		return errors.New("Aborted due to global error")
+	}
+	if abort.Load() {
+		return errors.New("Aborted due to interrupt")
+	}
+	if compressionoff.Load() {
+		return errcompressionoff
+	}
+	if batchreached.Load() {
+		return errbatchlimit
+	}
+	return nil
+}
+
+// sortqueue puts the collected files in the order asked for with --order
+func sortqueue(items []queueItem, order string) {
+	switch order {
+	case "mtime":
+		// Oldest first, files we couldn't stat go first too
+		sort.SliceStable(items, func(i, j int) bool {
+			if items[i].info == nil || items[j].info == nil {
+				return items[i].info == nil && items[j].info != nil
+			}
+			return items[i].info.ModTime().Before(items[j].info.ModTime())
+		})
+	case "size-desc":
+		// Most blocks first, as that's where the most space can be reclaimed
+		sort.SliceStable(items, func(i, j int) bool {
+			return ondisksize(items[i].info) > ondisksize(items[j].info)
+		})
+	case "path":
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].fp < items[j].fp
+		})
+	}
+}
+
+// ondisksize returns the space allocated to the file, or 0 if we don't know
+func ondisksize(fileinfo os.FileInfo) int64 {
+	if fileinfo == nil {
+		return 0
+	}
+	sysstat, ok := fileinfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return int64(sysstat.Blocks) * 512
+}
+
+// recompresspath processes a directory or a single file, and shows the effect on its dataset if there is one
+func recompresspath(root string) error {
+	rootinfo, err := os.Stat(root)
 	if err != nil {
-		log("Error walking directory: %v", err)
+		return err
+	}
+	dbpath := resumedbpath(root, "")
+	if !rootinfo.IsDir() {
+		// Nothing to resume for a single file
+		dbpath = ""
+	}
+
+	name, dserr := datasetforpath(root)
+	var ratiobefore string
+	if dserr == nil {
+		defer applyproperties(name)()
+		ratiobefore, dserr = zfsget(name, "compressratio")
+	}
+	if dserr != nil {
+		debug("Not reporting the dataset compression ratio: %v", dserr)
+	}
+
+	if *excludenewerthansnapshot && name == "" {
+		return fmt.Errorf("--exclude-newer-than-snapshot needs %s to be on a ZFS dataset: %w", root, dserr)
+	}
+
+	if name == "" || (!sharedblocks(name) && setsnapshotcutoff(name)) {
+		err = recompress(root, dbpath)
+	}
+
+	if dserr == nil {
+		zpoolsync(poolname(name))
+		if ratioafter, err := zfsget(name, "compressratio"); err == nil {
+			log("Compression ratio of dataset %s went from %vx to %vx", name, ratiobefore, ratioafter)
+		}
+	}
+	return err
+}
+
+// recompressdatasets processes every mounted dataset where it makes sense, one at a time
+func recompressdatasets() error {
+	datasets, err := listdatasets()
+	if err != nil {
+		return fmt.Errorf("Failed to list ZFS datasets: %w", err)
+	}
+
+	for _, ds := range datasets {
+		if abort.Load() {
+			return errors.New("Aborted due to interrupt")
+		}
+		if filecountreached.Load() {
+			break
+		}
+		// The list is from the start of the run, which may have been hours ago
+		if compression, err := zfsget(ds.name, "compression"); err == nil {
+			ds.compression = compression
+		}
+		if readonly, err := zfsget(ds.name, "readonly"); err == nil {
+			ds.readonly = readonly
+		}
+		if reason := ds.skipreason(); reason != "" {
+			log("Skipping dataset %s, %s", ds.name, reason)
+			continue
+		}
+
+		if sharedblocks(ds.name) || !setsnapshotcutoff(ds.name) {
+			continue
+		}
+
+		if *confirmeachdataset && !*yes {
+			ok, err := confirmdataset(ds)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				log("Skipping dataset %s, not confirmed", ds.name)
+				continue
+			}
+		}
+
+		log("Processing dataset %s mounted at %s", ds.name, ds.mountpoint)
+		restore := applyproperties(ds.name)
+		files, bytes := totalfiles.Load(), totalbytes.Load()
+		usedbefore, _ := datasetused(ds.name)
+		ratiobefore, _ := zfsget(ds.name, "compressratio")
+
+		compressionoff.Store(false)
+		stopwatching := watchcompression(ds.name, ds.compression)
+		err := recompress(ds.mountpoint, resumedbpath(ds.mountpoint, ds.name))
+		stopwatching()
+		restore()
+
+		zpoolsync(poolname(ds.name))
+		usedafter, _ := datasetused(ds.name)
+		ratioafter, _ := zfsget(ds.name, "compressratio")
+		log("Dataset %s: processed %v files, %v bytes, saved %v bytes, compression ratio went from %vx to %vx", ds.name,
+			totalfiles.Load()-files, totalbytes.Load()-bytes, int64(usedbefore)-int64(usedafter), ratiobefore, ratioafter)
+
+		if errors.Is(err, errcompressionoff) {
+			log("Moving on from dataset %s, its compression was turned off. The resume database is kept, so it continues where it left off once compression is back on.", ds.name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Dataset %s: %w", ds.name, err)
+		}
+	}
+	return nil
+}
+
+// mainflags are the flags only main looks at, the others are package variables
+type mainflags struct {
+	exclude, mimes, excludefrom                                                                                                                                  *[]string
+	ignore, ignoregroupnames, csvpath, journalpath, restoremtimesfrom, ownername, groupname, targetalgorithm, maxmemory, explainpath, resumeexport, resumeimport *string
+	noignore, listignoregroups, noskipcompressed, resumedump, comparealgorithmsflag, resumecompact, printconfig, printjson                                       *bool
+	sampleseed                                                                                                                                                   *int64
+}
+
+// defineflags sets up every flag on pflag.CommandLine
+func defineflags() mainflags {
+	var opts mainflags
+	opts.exclude = pflag.StringArray("exclude", nil, "Skip files and directories matching this gitignore style pattern, can be given more than once")
+	opts.mimes = pflag.StringArray("mime", nil, "Only process files whose content looks like this type, like text/* or application/pdf, can be given more than once. This reads the start of every file that passes the other checks, and only knows the types Go's net/http recognizes")
+	opts.excludefrom = pflag.StringArray("exclude-from", nil, "Read exclude patterns from this file, one per line, # starts a comment")
+	useignorefiles = pflag.Bool("use-ignore-files", false, "Also skip what the "+strings.Join(ignorefilenames, " and ")+" files in the tree exclude, each for the directory it is in and below")
+	opts.ignore = pflag.String("ignore", "", "Ignore files with these extensions instead of the --ignore-groups, or on top of them if --ignore-groups is given too")
+	opts.ignoregroupnames = pflag.String("ignore-groups", strings.Join(ignoregroupall(), ","), "Ignore files with extensions in these built in groups, \"none\" for no groups (see --list-ignore-groups)")
+	opts.noignore = pflag.Bool("no-ignore", false, "Don't skip any files by their extension, no groups, --ignore or "+propertyprefix+"ignore")
+	opts.listignoregroups = pflag.Bool("list-ignore-groups", false, "Show the built in groups of extensions to ignore and exit")
+	debugflag = pflag.Bool("debug", false, "Debug mode")
+	print0 = pflag.BoolP("print0", "0", false, "With --dry-run, write just the paths that would be recompressed to stdout, each ended by a NUL for xargs -0, and everything else to stderr")
+	noatime = pflag.Bool("noatime", false, "Read files without updating their access time (Linux only, needs to be the owner of the file or root)")
+	noresume = pflag.Bool("noresume", false, "Dont create or use the resume database")
+	resumedb = pflag.String("resume-db", "", "Where to keep the resume database (default is "+resumedbname+" in the directory being processed, with --all-datasets one subdirectory per dataset below this)")
+	resumememory = pflag.Bool("resume-memory", false, "Keep the resume database in memory only, for hardlink and skip tracking without writing anything to disk")
+	persistentresume = pflag.Bool("persistent-resume", false, "Keep the resume database after a run that got through everything, so later runs skip the files that didn't change size or modification time since they were handled")
+	resumeunsafefast = pflag.Bool("resume-unsafe-fast", false, "Don't sync every write to the resume database to disk, which is a lot faster with many small files. A crash of the system loses what was written since the last sync, and those files are rewritten again by the next run.")
+	resumecompactors = pflag.Int("resume-compactors", 2, "Number of goroutines compacting the resume database in the background, more keep it tidier while taking CPU and IO from the copying (Badger's default is 4)")
+	resumememtablevalue = pflag.String("resume-memtable-size", "16MiB", "Size of the in-memory tables of the resume database, up to 5 of them are kept; smaller ones use less memory but are written out and compacted more often (Badger's default is 64MiB)")
+	strict = pflag.Bool("strict", false, "Abort on any error while walking directories, instead of skipping the affected entries")
+	maxfilecount = pflag.Int("max-file-count", 0, "Stop looking for files after queueing this many, finish them and exit, for a quick trial run on part of the tree (0 = no limit)")
+	batchlimit = pflag.Int("batch-limit", 0, fmt.Sprintf("Stop after rewriting this many files and exit with code %v if there is more to do, the next run continues from the resume database (0 = no limit)", exitmorework))
+	heartbeatinterval = pflag.Duration("heartbeat", 0, "Write a line of JSON with the stats so far to stderr this often, for dashboards (0 = never)")
+	heartbeattotal = pflag.Bool("heartbeat-total", false, "With --heartbeat, count the files to do in the background first, and add the total, how far along the job is and an estimate of the time left to each line. What the resume database has as done counts from the start, so a resumed run doesn't begin at 0%")
+	throttle = pflag.Bool("throttle", false, "Use fewer threads while the pool is busy, going by zpool iostat (see --throttle-latency and --throttle-ops)")
+	throttlelatency = pflag.Duration("throttle-latency", 20*time.Millisecond, "With --throttle, back off when IO on the pool takes longer than this on average (0 = don't look at it)")
+	throttleops = pflag.Int("throttle-ops", 0, "With --throttle, back off when the pool does more reads and writes per second than this (0 = don't look at it)")
+	throttleinterval = pflag.Duration("throttle-interval", 10*time.Second, "With --throttle, how often to look at the load of the pool")
+	mountcheckinterval = pflag.Duration("mount-check-interval", time.Minute, fmt.Sprintf("Check this often that the filesystem being worked on is still mounted, and stop with exit code %v if not (0 = only notice from the errors)", exitfsunavailable))
+	compressioncheckinterval = pflag.Duration("compression-property-check-interval", 5*time.Minute, "With --all-datasets, check the compression property this often and move on to the next dataset if it is turned off (0 = only check when starting on a dataset)")
+	checkpointinterval = pflag.Duration("checkpoint-interval", time.Minute, "How often to save the progress counters to the resume database, so the summary covers the whole job across restarts (0 = only when stopping)")
+	interactive = pflag.Bool("interactive", false, "Ask before rewriting each file, answering all stops asking")
+	yes = pflag.Bool("yes", false, "Go ahead without asking, for big runs (see --confirm-above) and with --interactive")
+	treechecksum = pflag.Bool("tree-checksum", false, "Read all rewritten files back at the end, and check that the checksum over all of them matches the one of what was read before rewriting (reads everything twice)")
+	confirmeachdataset = pflag.Bool("confirm-each-dataset", false, "With --all-datasets, show what each dataset would rewrite and ask before processing it, unless --yes is given")
+	minfreevalue = pflag.String("min-free", "0", "Don't start on more files while the dataset has less than this much space available, taking copies into account (like 50GiB, 0 = no check)")
+	confirmabovevalue = pflag.String("confirm-above", "1TiB", "Ask for confirmation before rewriting more than this much data, unless --yes is given. The count walks the tree first, stopping once it gets past this (0 = never ask)")
+	opts.csvpath = pflag.String("csv", "", "Write a row for every file looked at to this CSV file: path, inode, size, on-disk bytes before and after, bytes saved, what was done and why, how long it took and the error if any")
+	opts.journalpath = pflag.String("mtime-journal", "", "Append the path, original and new modification time and change time of every rewritten file to this file")
+	opts.restoremtimesfrom = pflag.String("restore-mtimes", "", "Set the files in this --mtime-journal back to their original modification time and exit")
+	dryrun = pflag.String("dry-run", "", "Show what would be recompressed without changing anything, --dry-run=resume also keeps track of it in a throwaway resume database so the next --dry-run=resume continues from there")
+	pflag.Lookup("dry-run").NoOptDefVal = "on"
+	outputdir = pflag.String("output-dir", "", "Keep the resume database here instead of in the directory being processed, and a relative --csv or --mtime-journal path, created if needed and never processed (--resume-db still wins)")
+	mirrorto = pflag.String("mirror-to", "", "Write recompressed copies to the same relative paths below this directory, leaving the originals alone")
+	verifydataset = pflag.Bool("verify-dataset", false, "After the run, read back every rewritten file to check it can still be read without errors")
+	opts.ownername = pflag.String("owner", "", "Only process files owned by this user, name or uid")
+	opts.groupname = pflag.String("group", "", "Only process files with this group, name or gid")
+	force = pflag.Bool("force", false, "Rewrite files named on the command line even if the size, ignore list, resume or compression ratio checks would skip them")
+	skipdedup = pflag.Bool("skip-dedup", false, "Leave datasets with dedup enabled alone, rewriting deduplicated files uses more space")
+	fsync = pflag.Bool("fsync", false, "Flush every rewritten file to disk before moving on, skipped on datasets with sync=disabled")
+	keepgoing = pflag.Bool("keep-going", false, "Log errors processing files and carry on with the rest, instead of aborting on the first one")
+	maxerrors = pflag.Int("max-errors", 0, "Abort once this many errors have happened, even with --keep-going (0 = no limit)")
+	checksumcache = pflag.Bool("checksum-cache", false, "Store a content checksum in the resume database, so touched but unmodified files are not rewritten again")
+	skipratio = pflag.Float64("skipratio", 1.5, "Skip files that are already compressed more than this ratio (1.5:1 default, 0 = dont skip)")
+	auditskips = pflag.Bool("audit-skips", false, "Compress a few records of each file the ratio check skips, and report those that look like they would compress a lot better (read-only, implies --dry-run)")
+	skipminimal = pflag.Bool("skip-minimal", true, "Skip files of a single record that use no more than one sector already, which can't get any smaller (--skip-minimal=false to rewrite them anyway)")
+	opts.noskipcompressed = pflag.Bool("no-skip-compressed", false, "Rewrite files no matter how well compressed they already are, same as --skipratio 0 (use with --noresume for a complete second pass)")
+	opts.targetalgorithm = pflag.String("target-algorithm", "", "Compression algorithm the dataset now uses (like lz4, gzip-6 or zstd-3), files already compressed as well as it typically manages are skipped, unless --skipratio is given")
+	minfilesize = pflag.Int64("minfilesize", 16384, "Minimum filesize to process")
+	threads = pflag.Int32("threads", int32(runtime.NumCPU()*2), "Number of parallel file IO threads")
+	parallelism = pflag.String("parallelism", "fixed", "fixed runs --threads threads, auto starts with a few and tunes the number between 1 and --threads by the throughput it sees")
+	buffersize = pflag.Int32("buffersize", 16*1024*1024, "Buffer size per thread for IO")
+	pflag.StringVar(&tempprefix, "temp-prefix", tempprefix, "Name prefix for temporary files, they are never processed and removed when left behind by a crashed run. At least 4 characters, ending in -, _ or .")
+	keeporphans = pflag.Bool("keep-orphans", false, "Leave temporary files from crashed runs where they are, to look into what happened")
+	opts.maxmemory = pflag.String("max-memory", "0", "Use fewer threads or smaller buffers if needed to keep all the buffers within this much memory, like 512MiB (0 = no limit)")
+	queuesize = pflag.Int("queue-size", 0, "Number of files waiting for a free thread (0 = twice the number of threads)")
+	rewriteolderthan = pflag.Duration("rewrite-older-than", 0, "Rewrite files last written or recompressed longer ago than this, like 8760h, even if they are compressed well already. The resume database is kept to remember when each file was recompressed (0 = off)")
+	zdbcheck = pflag.Bool("zdb-check", false, "Ask zdb which compression the blocks of each file are stored with, instead of guessing from the ratio. Needs root and runs zdb once per file, which is slow")
+	excludenewerthansnapshot = pflag.Bool("exclude-newer-than-snapshot", false, "Only process files that haven't changed since the latest snapshot of their dataset, the ones zfs send has replicated already")
+	sincelastrun = pflag.Bool("since-last-run", false, "Only process files modified since the last run that got through everything, the time is kept next to the resume database")
+	verifycopies = pflag.Bool("verify-copies", false, "With --only-if-smaller, read each copy back and check it matches the original before it replaces it")
+	safe = pflag.Bool("safe", false, "Every file is either fully recompressed or left untouched: the same as --only-if-smaller --fsync --verify-copies")
+	onlyifsmaller = pflag.Bool("only-if-smaller", false, "Write the recompressed file to a temporary file first, and only replace the original if it uses fewer blocks")
+	samplerate = pflag.Float64("sample", 1, "Only process a random selection of files with this probability (0.0-1.0)")
+	opts.sampleseed = pflag.Int64("sample-seed", 0, "Random seed for --sample and --shuffle, to get the same selection again with the serial walk (default is random)")
+	parallelwalkers = pflag.Int("parallel-walk", 0, "Read this many directories in parallel while looking for files (0 = serial walk)")
+	pflag.Lookup("parallel-walk").NoOptDefVal = strconv.Itoa(runtime.NumCPU())
+	shuffle = pflag.Bool("shuffle", false, "Find all files first and process them in random order, spreading IO over the pool at the cost of memory")
+	randomizeorder = pflag.Int("randomize-order", 0, "Process the files in random order within a window of this many, spreading IO over more directories than walk order while using little memory (0 = walk order)")
+	pflag.Lookup("randomize-order").NoOptDefVal = "1000"
+	prefetch = pflag.Int("prefetch", 0, "Have the start of this many files ahead of the threads read into the cache, so they don't each wait for the first read on storage with high latency (0 = off)")
+	pflag.Lookup("prefetch").NoOptDefVal = "16"
+	walkorder = pflag.String("walk-order", "lexical", "How the serial walk goes through directories: lexical (into each subdirectory as it comes up), depth-first or breadth-first (all files of a directory before its subdirectories, finishing a subdirectory first or doing a level at a time)")
+	order = pflag.String("order", "", "Find all files first and process them in this order: mtime (oldest first), size-desc (most space used first) or path, at the cost of memory")
+	onefilesystem = pflag.Bool("one-file-system", false, "Don't descend into directories on other filesystems")
+	opts.resumedump = pflag.Bool("resume-dump", false, "Print the contents of the resume database in the current directory and exit")
+	opts.comparealgorithmsflag = pflag.Bool("compare-algorithms", false, "Compress the files in memory with several algorithms and show the ratios per extension, without changing anything (honors --sample, --threads and --buffersize)")
+	testblocksizevalue = pflag.String("test-block-size", "128KiB", "How much of each file --compare-algorithms compresses, in records spread over the file from the start (0 = all of it)")
+	opts.explainpath = pflag.String("explain", "", "Show which checks would cause this file to be skipped, and exit without changing anything")
+	opts.resumecompact = pflag.Bool("resume-compact", false, "Compact the resume database in the current directory to reclaim space and exit")
+	opts.resumeexport = pflag.String("resume-export", "", "Write the files the resume database in the current directory has handled to this file by path and checksum, for --resume-import on another machine, and exit")
+	opts.resumeimport = pflag.String("resume-import", "", "Add the files in this --resume-export file to the resume database in the current directory, those that have the same path and contents here, and exit")
+	timing = pflag.Bool("timing", false, "Show how much time was spent walking, reading and writing files, and in the resume database")
+	opts.printconfig = pflag.Bool("print-effective-config", false, "Show the value every option ends up with and where it came from, after all the checks, and exit")
+	opts.printjson = pflag.Bool("json", false, "With --print-effective-config, print it as JSON")
+	alldatasets = pflag.Bool("all-datasets", false, "Process every mounted ZFS dataset with compression enabled, one at a time, instead of the current directory")
+	return opts
+}
+
+func main() {
+	// Each command gets a flag set of its own, with all the flags but only its own shown
+	cmd, args := pickcommand(os.Args[1:])
+	name := os.Args[0]
+	if cmd != nil {
+		name += " " + cmd.name
+	}
+	pflag.CommandLine = pflag.NewFlagSet(name, pflag.ExitOnError)
+
+	opts := defineflags()
+	pflag.Usage = usage(cmd, pflag.CommandLine)
+	if cmd != nil {
+		cmd.restrictflags(pflag.CommandLine)
+	}
+	pflag.CommandLine.Parse(args)
+	given := givenflags(pflag.CommandLine)
+	if cmd != nil {
+		if err := cmd.setup(pflag.CommandLine); err != nil {
+			log("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *opts.printconfig && (*opts.resumedump || *opts.resumecompact || *opts.resumeexport != "" || *opts.resumeimport != "" || *opts.restoremtimesfrom != "" || *opts.listignoregroups || *opts.explainpath != "") {
+		log("--print-effective-config shows the options for a run, it can't be combined with options that do something else and exit")
+		os.Exit(1)
+	}
+	if *print0 {
+		if *dryrun == "" && !*auditskips {
+			log("--print0 is for the paths a --dry-run or list would recompress")
+			os.Exit(1)
+		}
+		logout = os.Stderr
+	}
+	if *opts.printjson && !*opts.printconfig {
+		log("--json is for --print-effective-config")
+		os.Exit(1)
+	}
+
+	if *opts.targetalgorithm != "" && !pflag.CommandLine.Changed("skipratio") {
+		ratio, known := expectedratio(*opts.targetalgorithm)
+		if !known {
+			log("Unknown compression algorithm %s", *opts.targetalgorithm)
+			os.Exit(1)
+		}
+		debug("Skipping files compressed more than %v:1, which is typical for %s", ratio, *opts.targetalgorithm)
+		*skipratio = ratio
+	}
+
+	if *opts.noskipcompressed {
+		if pflag.CommandLine.Changed("skipratio") || *opts.targetalgorithm != "" {
+			logerror("--no-skip-compressed overrides --skipratio and --target-algorithm")
+		}
+		logerror("Rewriting every file regardless of how well it is compressed already, this is as much IO as it gets")
+		*skipratio = 0
+	}
+
+	if *auditskips {
+		// Only looking, never rewriting
+		if *dryrun == "" {
+			*dryrun = "on"
+		}
+		auditwith = auditalgorithm(*opts.targetalgorithm)
+	}
+	switch *dryrun {
+	case "", "on", "resume":
+	default:
+		log("Unknown --dry-run %s, it can be resume or nothing", *dryrun)
+		os.Exit(1)
+	}
+
+	switch *order {
+	case "", "mtime", "size-desc", "path":
+	default:
+		log("Unknown order %s", *order)
+		os.Exit(1)
+	}
+	switch *walkorder {
+	case "lexical", "depth-first", "breadth-first":
+	default:
+		log("Unknown --walk-order %s, it can be lexical, depth-first or breadth-first", *walkorder)
 		os.Exit(1)
+	}
+	if *walkorder != "lexical" && (*parallelwalkers > 0 || *order != "" || *shuffle) {
+		log("--walk-order can't be combined with --parallel-walk, --order or --shuffle, which don't keep to the walk order")
+		os.Exit(1)
+	}
+	if *randomizeorder < 0 {
+		log("--randomize-order needs a window of one or more files")
+		os.Exit(1)
+	}
+	if *prefetch < 0 {
+		log("--prefetch needs one or more files to look ahead")
+		os.Exit(1)
+	}
+	if *randomizeorder > 0 && (*order != "" || *shuffle) {
+		log("--randomize-order can't be combined with --order or --shuffle, which already pick the order of all files")
+		os.Exit(1)
+	}
+	if *order != "" && *shuffle {
+		log("--order and --shuffle can't be combined")
+		os.Exit(1)
+	}
+
+	if *heartbeattotal && *heartbeatinterval == 0 {
+		log("--heartbeat-total adds to the lines of --heartbeat, which is off")
+		os.Exit(1)
+	}
+	if *persistentresume && (*noresume || *resumememory) {
+		log("--persistent-resume keeps the resume database on disk, there is none with --noresume or --resume-memory")
+		os.Exit(1)
+	}
+	if *resumeunsafefast && (*noresume || *resumememory) {
+		log("--resume-unsafe-fast is about writing the resume database to disk, there is none with --noresume or --resume-memory")
+		os.Exit(1)
+	}
+	if *resumememory && (*noresume || *resumedb != "" || *opts.resumedump || *opts.resumecompact || *opts.resumeexport != "" || *opts.resumeimport != "") {
+		log("--resume-memory can't be combined with --noresume, --resume-db, --resume-dump, --resume-compact, --resume-export or --resume-import")
+		os.Exit(1)
+	}
+
+	if *opts.resumedump {
+		if err := dumpresume(resumedbpath(".", "")); err != nil {
+			log("Failed to read resume database: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *opts.resumecompact {
+		if err := compactresume(resumedbpath(".", "")); err != nil {
+			log("Failed to compact resume database: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *opts.resumeexport != "" {
+		if err := exportresume(".", resumedbpath(".", ""), *opts.resumeexport); err != nil {
+			log("Failed to export resume database: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *opts.resumeimport != "" {
+		if err := importresume(".", resumedbpath(".", ""), *opts.resumeimport); err != nil {
+			log("Failed to import into resume database: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if value, err := humanize.ParseBytes(*testblocksizevalue); err != nil {
+		log("Invalid --test-block-size %q: %v", *testblocksizevalue, err)
+		os.Exit(1)
+	} else {
+		testblocksize = value
+	}
+	if *resumecompactors < 2 {
+		log("--resume-compactors needs to be 2 or more, Badger keeps one for the first level alone")
+		os.Exit(1)
+	}
+	if value, err := humanize.ParseBytes(*resumememtablevalue); err != nil || value < 1<<20 {
+		log("Invalid --resume-memtable-size %q, it needs to be 1MiB or more", *resumememtablevalue)
+		os.Exit(1)
+	} else {
+		resumememtable = value
+	}
+	if value, err := humanize.ParseBytes(*minfreevalue); err != nil {
+		log("Invalid --min-free %q: %v", *minfreevalue, err)
+		os.Exit(1)
+	} else {
+		minfree = value
+	}
+	if value, err := humanize.ParseBytes(*confirmabovevalue); err != nil {
+		log("Invalid --confirm-above %q: %v", *confirmabovevalue, err)
+		os.Exit(1)
+	} else {
+		confirmabove = value
+	}
+	if err := checktempprefix(tempprefix); err != nil {
+		log("%v", err)
+		os.Exit(1)
+	}
+	if *threads < 1 || *buffersize < 4096 {
+		log("Need at least 1 thread and a buffer size of at least 4096 bytes")
+		os.Exit(1)
+	}
+	if limit, err := humanize.ParseBytes(*opts.maxmemory); err != nil {
+		log("Invalid --max-memory %q: %v", *opts.maxmemory, err)
+		os.Exit(1)
+	} else {
+		fitmemory(limit)
+	}
+
+	if *opts.ownername != "" {
+		uid, err := parseowner(*opts.ownername)
+		if err != nil {
+			log("%v", err)
+			os.Exit(1)
+		}
+		owneruid = uid
+	}
+	if *opts.groupname != "" {
+		gid, err := parsegroup(*opts.groupname)
+		if err != nil {
+			log("%v", err)
+			os.Exit(1)
+		}
+		ownergid = gid
+	}
+
+	if *opts.restoremtimesfrom != "" {
+		if err := restoremtimes(outputpath(*opts.restoremtimesfrom)); err != nil {
+			log("Failed to restore modification times: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *outputdir != "" {
+		if err := os.MkdirAll(*outputdir, 0755); err != nil {
+			log("Failed to create output directory: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *opts.journalpath != "" && *dryrun == "" {
+		var err error
+		journal, err = openjournal(outputpath(*opts.journalpath))
+		if err != nil {
+			log("Failed to open mtime journal: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *opts.csvpath != "" {
+		var err error
+		csvout, err = opencsv(outputpath(*opts.csvpath))
+		if err != nil {
+			log("Failed to open the CSV file: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *maxfilecount < 0 {
+		log("--max-file-count needs one or more files")
+		os.Exit(1)
+	}
+	if *batchlimit > 0 && (*noresume || *resumememory) {
+		log("--batch-limit needs a resume database on disk, so the next run knows where to continue")
+		os.Exit(1)
+	}
+
+	if *parallelism != "fixed" && *parallelism != "auto" {
+		log("--parallelism is fixed or auto, not %q", *parallelism)
+		os.Exit(1)
+	}
+	if *parallelism == "auto" && *throttle {
+		log("--parallelism auto and --throttle both decide how many threads run, use one or the other")
+		os.Exit(1)
+	}
+	if *throttle && *throttlelatency <= 0 && *throttleops <= 0 {
+		log("--throttle needs --throttle-latency or --throttle-ops to go by")
+		os.Exit(1)
+	}
+
+	if *sincelastrun && *resumememory {
+		log("--since-last-run needs somewhere on disk to keep the time of the last run, it can't be used with --resume-memory")
+		os.Exit(1)
+	}
+	if *sincelastrun && *rewriteolderthan > 0 {
+		log("--since-last-run skips the old files --rewrite-older-than is for, use one or the other")
+		os.Exit(1)
+	}
+	if *rewriteolderthan > 0 && (*noresume || *resumememory) {
+		log("Warning: without a resume database on disk --rewrite-older-than only goes by the modification time, and rewriting keeps that, so old files are rewritten on every run")
+	}
+
+	if *alldatasets && pflag.NArg() > 0 {
+		log("--all-datasets processes all datasets, it can't be combined with paths")
+		os.Exit(1)
+	}
+
+	if *safe {
+		if *mirrorto != "" {
+			log("--safe can't be used with --mirror-to, the originals are left alone there anyway")
+			os.Exit(1)
+		}
+		*onlyifsmaller = true
+		*fsync = true
+		*verifycopies = true
+	}
+	if *verifycopies && !*onlyifsmaller {
+		log("--verify-copies checks the copies made with --only-if-smaller, it needs that too")
+		os.Exit(1)
+	}
+
+	if *mirrorto != "" {
+		switch {
+		case *alldatasets:
+			log("--mirror-to can't be used with --all-datasets")
+			os.Exit(1)
+		case *onlyifsmaller:
+			log("--mirror-to can't be used with --only-if-smaller, the originals are never replaced")
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(*mirrorto, 0755); err != nil {
+			log("Failed to create mirror directory: %v", err)
+			os.Exit(1)
+		}
+		// The walk stays out of the mirror, so copies left behind in there are cleaned up here
+		if err := cleanorphans(*mirrorto); err != nil {
+			log("Failed to look for temporary files in the mirror directory: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *treechecksum && *dryrun != "" {
+		log("--tree-checksum checks what a run rewrote, a dry run doesn't rewrite anything")
+		os.Exit(1)
+	}
+	if *confirmeachdataset && !*alldatasets {
+		log("--confirm-each-dataset goes with --all-datasets")
+		os.Exit(1)
+	}
+	if *confirmeachdataset && !*yes && !stdinterminal() {
+		log("--confirm-each-dataset needs a terminal to ask questions on, use --yes to go ahead without them")
+		os.Exit(1)
+	}
+	if *interactive && !*yes && !stdinterminal() {
+		log("--interactive needs a terminal to ask questions on, use --yes to go ahead without them")
+		os.Exit(1)
+	}
+
+	if *opts.listignoregroups {
+		for _, group := range ignoregroups {
+			log("%-11s %s: %s", group.name, group.description, strings.Join(group.extensions, ","))
+		}
+		os.Exit(0)
+	}
+	if *opts.noignore {
+		if pflag.CommandLine.Changed("ignore") || pflag.CommandLine.Changed("ignore-groups") {
+			log("--no-ignore can't be combined with --ignore or --ignore-groups")
+			os.Exit(1)
+		}
+		logerror("Not ignoring any extensions, already compressed files like videos and archives get read and rewritten too, which is a lot of IO for nothing")
+		*opts.ignoregroupnames = "none"
+	}
+	var extensions []string
+	if !pflag.CommandLine.Changed("ignore") || pflag.CommandLine.Changed("ignore-groups") {
+		groupextensions, err := ignoregroupextensions(*opts.ignoregroupnames)
+		if err != nil {
+			log("%v", err)
+			os.Exit(1)
+		}
+		extensions = append(extensions, groupextensions...)
+	}
+	if *opts.ignore != "" {
+		extensions = append(extensions, *opts.ignore)
+	}
+	ignorelist = parseignore(strings.Join(extensions, ","))
+	for _, text := range *opts.exclude {
+		p, err := parseexclude(text)
+		if err != nil {
+			log("%v", err)
+			os.Exit(1)
+		}
+		excludes = append(excludes, p)
+	}
+	for _, text := range *opts.mimes {
+		pattern, err := parsemime(text)
+		if err != nil {
+			log("%v", err)
+			os.Exit(1)
+		}
+		mimepatterns = append(mimepatterns, pattern)
+	}
+	for _, fp := range *opts.excludefrom {
+		patterns, err := readexcludes(fp)
+		if err != nil {
+			log("Failed to read exclude patterns: %v", err)
+			os.Exit(1)
+		}
+		excludes = append(excludes, patterns...)
+	}
+
+	if *opts.explainpath != "" {
+		if err := explain(*opts.explainpath); err != nil {
+			log("Failed to explain %s: %v", *opts.explainpath, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *samplerate < 0 || *samplerate > 1 {
+		log("Sample rate must be between 0.0 and 1.0")
+		os.Exit(1)
+	}
+	if !pflag.CommandLine.Changed("sample-seed") {
+		*opts.sampleseed = time.Now().UnixNano()
+	}
+	if *samplerate < 1 {
+		log("Sampling %v%% of files using seed %v", *samplerate*100, *opts.sampleseed)
+	}
+	sampler = rand.New(rand.NewSource(*opts.sampleseed))
+
+	if *queuesize <= 0 {
+		*queuesize = int(*threads) * 2
+	}
+	if *alldatasets {
+		// Nested datasets get their own turn
+		*onefilesystem = true
+	}
+
+	if *opts.printconfig {
+		if err := printeffectiveconfig(pflag.CommandLine, given, cmd, *opts.printjson); err != nil {
+			log("Failed to print the configuration: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Ctrl-C and SIGTERM (systemctl stop and friends) handler to set abort
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		log("Terminating, please wait for threads to finish tasks ...")
+		abort.Store(true)
+	}()
+
+	if *opts.comparealgorithmsflag {
+		roots := pflag.Args()
+		if len(roots) == 0 {
+			roots = []string{"."}
+		}
+		if err := comparealgorithmsfor(roots); err != nil {
+			log("Failed to compare algorithms: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if verifyonly {
+		roots := pflag.Args()
+		if len(roots) == 0 {
+			roots = []string{"."}
+		}
+		if failed := verifytree(roots); failed > 0 {
+			log("%v files could not be read back", failed)
+			os.Exit(1)
+		}
+		log("All files read back fine")
+		return
+	}
+
+	if *dryrun == "" && *mirrorto == "" {
+		warnbackups()
+	}
+
+	var err error
+	if *alldatasets {
+		err = recompressdatasets()
 	} else {
-		if !*noresume {
-			os.RemoveAll(".zfs-inplace-recompress-resume")
+		roots := pflag.Args()
+		if len(roots) == 0 {
+			roots = []string{"."}
+		}
+		for _, root := range roots {
+			if err = recompresspath(root); err != nil || filecountreached.Load() {
+				break
+			}
+		}
+	}
+
+	if *treechecksum && !abort.Load() {
+		if checkerr := checktree(); checkerr != nil {
+			if err == nil {
+				err = checkerr
+			} else {
+				logerror("%v", checkerr)
+			}
 		}
 	}
 
+	log("Processed %v files, %v bytes", totalfiles.Load(), totalbytes.Load())
+	log("Skipped %v files, %v bytes", skipfiles.Load(), skipbytes.Load())
+	if savedbytes.Load() > 0 {
+		log("Freed %v bytes by replacing files with smaller copies", savedbytes.Load())
+	}
+	if notsmallerfiles.Load() > 0 {
+		log("Kept %v files as they were, recompressing did not make them smaller", notsmallerfiles.Load())
+	}
+	if summary := ignoresummary(); summary != "" {
+		log("Skipped by extension: %s", summary)
+	}
+	logsavings()
+	if minimalfiles.Load() > 0 {
+		log("Skipped %v files of a single record using one sector already, the least they can", minimalfiles.Load())
+	}
+	if *auditskips {
+		log("Audited %v files skipped by the ratio check, %v of them look like they would compress better", auditedfiles.Load(), suspectskips.Load())
+	}
+	if freespacewaited.Load() > 0 {
+		log("Waited %v summed over all threads for space to free up, to stay above --min-free %s", time.Duration(freespacewaited.Load()).Round(time.Second), *minfreevalue)
+	}
+	if mimeskipped.Load() > 0 {
+		log("Skipped %v files whose type doesn't match --mime %s", mimeskipped.Load(), strings.Join(mimepatterns, ", "))
+	}
+	if orphansremoved.Load() > 0 {
+		log("Removed %v temporary files left behind by earlier runs", orphansremoved.Load())
+	}
+	if journal != nil {
+		if err := journal.close(); err != nil {
+			logerror("Failed to write the mtime journal: %v", err)
+		}
+	}
+	if csvout != nil {
+		if err := csvout.close(); err != nil {
+			logerror("Failed to write the CSV file: %v", err)
+		}
+	}
+	if *timing {
+		logtiming()
+	}
+	if *dryrun != "" {
+		log("This was a dry run, no files were changed")
+	}
+	if walkerrors.Load() > 0 {
+		logerror("Encountered %v errors while walking directories, some files were not processed", walkerrors.Load())
+	}
+	if longpaths.Load() > 0 {
+		logerror("Skipped %v files and directories with paths longer than the system allows", longpaths.Load())
+	}
+	if fileerrors.Load() > 0 {
+		logerror("Encountered %v errors processing files", fileerrors.Load())
+		if err == nil {
+			err = errors.New("Some files could not be processed")
+		}
+	}
+
+	if filecountreached.Load() && err == nil {
+		log("Stopped after queueing %v files as asked with --max-file-count", *maxfilecount)
+	}
+	if errors.Is(err, errfsunavailable) {
+		log("%v", err)
+		os.Exit(exitfsunavailable)
+	}
+	if errors.Is(err, errbatchlimit) {
+		log("Rewrote %v files as asked with --batch-limit, run again to continue", *batchlimit)
+		os.Exit(exitmorework)
+	}
+	if err != nil {
+		log("%v", err)
+		os.Exit(1)
+	}
 }
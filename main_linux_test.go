@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// openfds counts the open file descriptors of the process
+func openfds(tb testing.TB) int {
+	tb.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		tb.Skipf("Can't count file descriptors: %v", err)
+	}
+	return len(entries)
+}
+
+// direntry returns the entry for fp like the walk gets it
+func direntry(tb testing.TB, fp string) fs.DirEntry {
+	tb.Helper()
+	info, err := os.Lstat(fp)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fs.FileInfoToDirEntry(info)
+}
+
+// withoutwriteaccess runs fn with the permissions of a user that may read the
+// test files but not write them. For root that's done by giving up the file
+// system uid on this thread only, which drops the capability to override them.
+func withoutwriteaccess(t *testing.T, fn func()) {
+	if os.Geteuid() != 0 {
+		fn()
+		return
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	const nobody = 65534
+	syscall.Syscall(syscall.SYS_SETFSUID, nobody, 0, 0)
+	defer syscall.Syscall(syscall.SYS_SETFSUID, 0, 0, 0)
+	if prev, _, _ := syscall.Syscall(syscall.SYS_SETFSUID, nobody, 0, 0); prev != nobody {
+		t.Skip("Can't change the file system uid")
+	}
+	fn()
+}
+
+// A file that can be read but not written is skipped, and leaves nothing open
+func TestProcessReadOnlyFile(t *testing.T) {
+	testflags(t)
+	// Not t.TempDir(), its parent is only open to the user running the tests
+	dir, err := os.MkdirTemp("", "zir-readonly-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(dir, "readonly.txt")
+	writefile(t, fp, 64<<10, []byte("can't touch this\n"))
+	if err := os.Chmod(fp, 0444); err != nil {
+		t.Fatal(err)
+	}
+	// Once first, so whatever the runtime opens for the first file is open already
+	buffer := recordbuffer(*buffersize)
+	withoutwriteaccess(t, func() { processfile(fp, direntry(t, fp), false, nil, buffer) })
+
+	before := openfds(t)
+	for i := 0; i < 10; i++ {
+		var result fileresult
+		withoutwriteaccess(t, func() { result, err = processfile(fp, direntry(t, fp), false, nil, buffer) })
+		if err != nil || result.action != actionskipped {
+			t.Fatalf("processfile = %+v, %v, want a skip", result, err)
+		}
+	}
+	if after := openfds(t); after != before {
+		t.Errorf("%v file descriptors open before, %v after", before, after)
+	}
+}
+
+// Files that fail after they were opened leave nothing open, and neither do
+// the ones that go well
+func TestProcessFileDescriptors(t *testing.T) {
+	testflags(t)
+	dir := t.TempDir()
+	const files = 50
+	for i := 0; i < files; i++ {
+		writefile(t, filepath.Join(dir, fmt.Sprintf("file%02d.txt", i)), 64<<10, []byte("some text\n"))
+	}
+	buffer := recordbuffer(*buffersize)
+	processfile(filepath.Join(dir, "file00.txt"), direntry(t, filepath.Join(dir, "file00.txt")), true, nil, buffer)
+
+	before := openfds(t)
+	for i := 0; i < files; i++ {
+		fp := filepath.Join(dir, fmt.Sprintf("file%02d.txt", i))
+		fileinfo, err := os.Lstat(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// What the walk saw is not what gets copied, so the copy fails once done
+		stale := *fileinfo.Sys().(*syscall.Stat_t)
+		stale.Size++
+		if err := rewriteinplace(fp, fileinfo, &stale, buffer, nil); err == nil {
+			t.Fatalf("rewriteinplace of %s didn't fail on the wrong size", fp)
+		}
+		*onlyifsmaller = i%2 == 0
+		if _, err := processfile(fp, direntry(t, fp), true, nil, buffer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := openfds(t); after != before {
+		t.Errorf("%v file descriptors open before, %v after", before, after)
+	}
+}
+
+// mkdeep makes a chain of directories longer than PATH_MAX below root, each made
+// relative to the one above it as the whole path can't be used, and puts a file
+// at the bottom
+func mkdeep(t *testing.T, root string) {
+	t.Helper()
+	name := strings.Repeat("d", 200)
+	fd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for depth := 0; depth < 25; depth++ {
+		if err := syscall.Mkdirat(fd, name, 0755); err != nil {
+			t.Fatal(err)
+		}
+		sub, err := syscall.Openat(fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		syscall.Close(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd = sub
+	}
+	file, err := syscall.Openat(fd, "deep.txt", syscall.O_WRONLY|syscall.O_CREAT, 0644)
+	syscall.Close(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(file), "deep.txt")
+	defer f.Close()
+	if _, err := f.Write(bytes.Repeat([]byte("deep down\n"), 10000)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Paths longer than PATH_MAX, and temporary file names longer than NAME_MAX, are
+// skipped and counted, and the rest of the run goes on
+func TestLongPaths(t *testing.T) {
+	t.Run("PATH_MAX", func(t *testing.T) {
+		testflags(t)
+		root := t.TempDir()
+		mkdeep(t, root)
+		writefile(t, filepath.Join(root, "shallow.txt"), 64<<10, []byte("up here\n"))
+		before, rewritten := longpaths.Load(), totalfiles.Load()
+		if err := recompress(root, ""); err != nil {
+			t.Fatal(err)
+		}
+		if longpaths.Load() == before {
+			t.Error("Path longer than PATH_MAX not counted")
+		}
+		if totalfiles.Load()-rewritten != 1 {
+			t.Errorf("Rewrote %v files, want the shallow one", totalfiles.Load()-rewritten)
+		}
+	})
+	t.Run("NAME_MAX", func(t *testing.T) {
+		saved := tempprefix
+		t.Cleanup(func() { tempprefix = saved })
+		testflags(t, "--only-if-smaller", "--temp-prefix", strings.Repeat("t", 250)+"-")
+		root := t.TempDir()
+		writefile(t, filepath.Join(root, "file.txt"), 64<<10, []byte("some text\n"))
+		before := longpaths.Load()
+		if err := recompress(root, ""); err != nil {
+			t.Fatal(err)
+		}
+		if longpaths.Load() == before {
+			t.Error("Temporary file name longer than NAME_MAX not counted")
+		}
+	})
+}
+
+// With --only-if-smaller a file of someone else that the copy can't be given to
+// is skipped, and left as it was
+func TestOnlyIfSmallerOtherOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Needs root to make a file of someone else")
+	}
+	testflags(t, "--only-if-smaller")
+	dir, err := os.MkdirTemp("", "zir-owner-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// Anyone may make the copy next to it, only the owner may give it to root
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(dir, "zeroes.bin")
+	// Written zeroes take blocks, the copy has holes there so it comes out smaller
+	writefile(t, fp, 1<<20, []byte{0})
+	before, err := os.Lstat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result fileresult
+	withoutwriteaccess(t, func() { result, err = processfile(fp, direntry(t, fp), false, nil, recordbuffer(*buffersize)) })
+	if err != nil || result.action != actionskipped {
+		t.Fatalf("processfile = %+v, %v, want a skip", result, err)
+	}
+	after, err := os.Lstat(fp)
+	if err != nil || !os.SameFile(before, after) {
+		t.Errorf("The original was replaced: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%v files left in the directory, want only the original", len(entries))
+	}
+}
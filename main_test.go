@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/pflag"
+)
+
+// testflags sets up the flags like main does for a run with the given arguments,
+// with the resume database off unless the test turns it on, and logging quiet
+func testflags(tb testing.TB, args ...string) {
+	tb.Helper()
+	pflag.CommandLine = pflag.NewFlagSet("test", pflag.ContinueOnError)
+	opts := defineflags()
+	if err := pflag.CommandLine.Parse(append([]string{"--noresume"}, args...)); err != nil {
+		tb.Fatal(err)
+	}
+	extensions, err := ignoregroupextensions(*opts.ignoregroupnames)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ignorelist = parseignore(strings.Join(extensions, ","))
+	sampler = rand.New(rand.NewSource(1))
+	memtable, err := humanize.ParseBytes(*resumememtablevalue)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	resumememtable = memtable
+	if *queuesize <= 0 {
+		*queuesize = int(*threads) * 2
+	}
+	logout = io.Discard
+	tb.Cleanup(func() {
+		logout = os.Stdout
+	})
+}
+
+// writefile writes size bytes of content, repeated as far as needed
+func writefile(tb testing.TB, fp string, size int, content []byte) {
+	tb.Helper()
+	data := bytes.Repeat(content, size/len(content)+1)[:size]
+	if err := os.WriteFile(fp, data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// synthetictree makes a tree like the ones the tool runs on: many small files
+// in many directories, a few large ones and some that are compressed already.
+// It returns how many bytes are in it.
+func synthetictree(tb testing.TB, root string) int64 {
+	tb.Helper()
+	text := []byte("The quick brown fox jumps over the lazy dog, again and again.\n")
+	random := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	var total int64
+	for d := 0; d < 20; d++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%02d", d))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for i := 0; i < 25; i++ {
+			writefile(tb, filepath.Join(dir, fmt.Sprintf("small%02d.txt", i)), 32<<10, text)
+			total += 32 << 10
+		}
+	}
+	for i := 0; i < 4; i++ {
+		writefile(tb, filepath.Join(root, fmt.Sprintf("large%d.log", i)), 8<<20, text)
+		total += 8 << 20
+	}
+	for i := 0; i < 4; i++ {
+		// Random data, and an extension that's ignored as compressed
+		writefile(tb, filepath.Join(root, fmt.Sprintf("random%d.bin", i)), 2<<20, random)
+		writefile(tb, filepath.Join(root, fmt.Sprintf("archive%d.gz", i)), 2<<20, random)
+		total += 4 << 20
+	}
+	return total
+}
+
+// BenchmarkRecompress runs the whole pipeline from the walk to the rewrites over
+// a synthetic tree, with different numbers of threads and buffer sizes. Besides the
+// throughput it reports the time spent in each phase like --timing does, the copy and
+// database times summed over all threads, so a regression shows where it is.
+func BenchmarkRecompress(b *testing.B) {
+	root := b.TempDir()
+	total := synthetictree(b, root)
+	for _, threads := range []int{1, 4, 16} {
+		for _, buffersize := range []int{128 << 10, 1 << 20, 16 << 20} {
+			b.Run(fmt.Sprintf("threads=%d/buffersize=%dKiB", threads, buffersize>>10), func(b *testing.B) {
+				// A resume database in memory, so its time is in there too
+				testflags(b, "--noresume=false", "--resume-memory", "--prefetch", "16",
+					"--threads", fmt.Sprint(threads), "--buffersize", fmt.Sprint(buffersize))
+				b.SetBytes(total)
+				phases := []*atomic.Int64{&walktime, &copytime, &dbtime, &prefetchtime}
+				before := make([]int64, len(phases))
+				for i, phase := range phases {
+					before[i] = phase.Load()
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := recompress(root, ""); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				for i, unit := range []string{"walk-ns/op", "copy-ns/op", "db-ns/op", "prefetch-ns/op"} {
+					b.ReportMetric(float64(phases[i].Load()-before[i])/float64(b.N), unit)
+				}
+			})
+		}
+	}
+}
+
+// A FIFO or a symlink put in place of a file after the walk saw it is skipped,
+// and opening the FIFO doesn't hang waiting for a writer
+func TestRewriteReplacedFile(t *testing.T) {
+	testflags(t)
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "file.txt")
+	writefile(t, fp, 64<<10, []byte("some text\n"))
+	fileinfo, err := os.Lstat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysstat := fileinfo.Sys().(*syscall.Stat_t)
+	other := filepath.Join(dir, "other.txt")
+	writefile(t, other, 64<<10, []byte("other text\n"))
+
+	for name, replace := range map[string]func() error{
+		"fifo":    func() error { return syscall.Mkfifo(fp, 0644) },
+		"symlink": func() error { return os.Symlink(other, fp) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if err := replace(); err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error, 1)
+			go func() {
+				done <- rewriteinplace(fp, fileinfo, sysstat, recordbuffer(*buffersize), nil)
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, errnotregular) || !skippable(err) {
+					t.Errorf("rewriteinplace = %v, want a skip for a file that isn't regular", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("rewriteinplace hangs on a FIFO")
+			}
+		})
+	}
+	if data, err := os.ReadFile(other); err != nil || !bytes.HasPrefix(data, []byte("other text\n")) {
+		t.Errorf("The symlink target was changed: %v", err)
+	}
+}
+
+// statentry is a directory entry like the walk gets, that fails Info() with err
+// if set, and counts how often it was asked
+type statentry struct {
+	fs.DirEntry
+	err   error
+	infos int
+}
+
+func (e *statentry) Info() (fs.FileInfo, error) {
+	e.infos++
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.DirEntry.Info()
+}
+
+// A file that can't be stat'ed is skipped, it doesn't fail the run
+func TestProcessStatFails(t *testing.T) {
+	testflags(t)
+	fp := filepath.Join(t.TempDir(), "file.txt")
+	writefile(t, fp, 64<<10, []byte("some text\n"))
+	info, err := os.Lstat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		err    error
+		reason string
+	}{
+		{fs.ErrNotExist, "gone"},
+		{syscall.EIO, "can't stat it"},
+		{&fs.PathError{Op: "lstat", Path: fp, Err: syscall.ESTALE}, "can't stat it"},
+		{syscall.ENAMETOOLONG, "path too long"},
+	} {
+		entry := &statentry{DirEntry: fs.FileInfoToDirEntry(info), err: c.err}
+		result, err := processfile(fp, entry, false, nil, recordbuffer(*buffersize))
+		if err != nil || result.action != actionskipped || result.reason != c.reason {
+			t.Errorf("processfile with Info() failing with %v = %+v, %v, want skipped as %q", c.err, result, err, c.reason)
+		}
+	}
+}
+
+// An --output-dir inside the tree isn't processed, what's written there changes while we go
+func TestOutputDirSkipped(t *testing.T) {
+	root := t.TempDir()
+	output := filepath.Join(root, "output")
+	testflags(t, "--output-dir", output)
+	if err := os.Mkdir(output, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writefile(t, filepath.Join(root, "file.txt"), 64<<10, []byte("some text\n"))
+	writefile(t, filepath.Join(output, "report.csv"), 64<<10, []byte("a,b,c\n"))
+	if got := outputpath("report.csv"); got != filepath.Join(output, "report.csv") {
+		t.Errorf("outputpath(report.csv) = %s, want it in --output-dir", got)
+	}
+	before := totalfiles.Load()
+	if err := recompress(root, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := totalfiles.Load() - before; got != 1 {
+		t.Errorf("Rewrote %v files, want only the one outside --output-dir", got)
+	}
+}
+
+// With --order the walk stat's the files to sort them, processfile uses that
+// instead of doing it again
+func TestOrderedStatOnce(t *testing.T) {
+	testflags(t, "--order", "size-desc")
+	fp := filepath.Join(t.TempDir(), "file.txt")
+	writefile(t, fp, 64<<10, []byte("some text\n"))
+	info, err := os.Lstat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &statentry{DirEntry: fs.FileInfoToDirEntry(info)}
+	item := queueItem{fp: fp, fi: entry}
+	item.lookup()
+	result, err := processfile(item.fp, item.entry(), item.forced, nil, recordbuffer(*buffersize))
+	if err != nil || result.action != actionrewritten {
+		t.Fatalf("processfile = %+v, %v", result, err)
+	}
+	if entry.infos != 1 {
+		t.Errorf("File stat'ed %v times, want once", entry.infos)
+	}
+}
+
+// --batch-limit only says there's more to do once a file was turned away, and those
+// files are skipped rather than failed
+func TestBatchLimit(t *testing.T) {
+	t.Cleanup(func() {
+		batchcount.Store(0)
+		batchreached.Store(false)
+	})
+	for files, wantmore := range map[int]bool{3: false, 4: true} {
+		testflags(t, "--threads", "1", "--batch-limit", "3")
+		batchcount.Store(0)
+		batchreached.Store(false)
+		root := t.TempDir()
+		for i := 0; i < files; i++ {
+			writefile(t, filepath.Join(root, fmt.Sprintf("file%d.txt", i)), 64<<10, []byte("some text\n"))
+		}
+		var results []fileresult
+		for i := 0; i < files; i++ {
+			fp := filepath.Join(root, fmt.Sprintf("file%d.txt", i))
+			info, err := os.Lstat(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := processfile(fp, fs.FileInfoToDirEntry(info), false, nil, recordbuffer(*buffersize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, result)
+		}
+		if got := errors.Is(stopped(), errbatchlimit); got != wantmore {
+			t.Errorf("With %v files and --batch-limit 3, more to do is %v", files, got)
+		}
+		if last := results[len(results)-1]; wantmore && (last.action != actionskipped || last.reason != "batch limit reached") {
+			t.Errorf("File past the batch limit got %+v, want a skip", last)
+		}
+	}
+}
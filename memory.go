@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+)
+
+// Buffers aren't made smaller than this to fit --max-memory while fewer threads would also do
+const minbuffersize = 1024 * 1024
+
+// fitmemory shrinks the buffers and, if that isn't enough, the number of threads so that
+// all the copy buffers together stay within limit bytes
+func fitmemory(limit uint64) {
+	if limit == 0 || uint64(*threads)*uint64(*buffersize) <= limit {
+		return
+	}
+	wantthreads, wantbuffersize := *threads, *buffersize
+
+	// Parallelism helps more than buffers beyond a megabyte, so the buffers go first
+	if size := limit / uint64(*threads); size >= minbuffersize {
+		*buffersize = int32(size / holesize * holesize)
+	} else {
+		if *buffersize > minbuffersize {
+			*buffersize = minbuffersize
+		}
+		*threads = int32(max(1, limit/uint64(*buffersize)))
+		if uint64(*buffersize) > limit {
+			// A single thread with a small buffer, it'll be slow but it works
+			*buffersize = int32(max(4096, limit/4096*4096))
+		}
+	}
+
+	log("Warning: %v threads with %v buffers take %v, more than --max-memory %v. Using %v threads with %v buffers instead.",
+		wantthreads, humanize.IBytes(uint64(wantbuffersize)), humanize.IBytes(uint64(wantthreads)*uint64(wantbuffersize)),
+		humanize.IBytes(limit), *threads, humanize.IBytes(uint64(*buffersize)))
+}
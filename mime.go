@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// How much of a file is looked at to tell its type, all net/http looks at
+const sniffsize = 512
+
+// The --mime patterns, like text/* or application/pdf. Empty means all types.
+var mimepatterns []string
+
+var mimeskipped atomic.Uint64
+
+// parsemime checks a --mime pattern, matching is on the type without parameters
+func parsemime(pattern string) (string, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if !strings.Contains(pattern, "/") {
+		return "", fmt.Errorf("--mime %q should be a type and subtype like text/plain or text/*", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", fmt.Errorf("--mime %q: %w", pattern, err)
+	}
+	return pattern, nil
+}
+
+// sniffmime tells the type of the file from its first sniffsize bytes, like
+// net/http does for a response without a Content-Type. That knows the common
+// archive, image, document and text formats, anything else is
+// application/octet-stream. The read is cheap: it's the first record, which the
+// rewrite then finds in the cache.
+func sniffmime(fp string, buffer []byte) (string, error) {
+	f, err := regularonly(opensource(fp))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := buffer[:min(sniffsize, len(buffer))]
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	mediatype, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if err != nil {
+		return "", err
+	}
+	return mediatype, nil
+}
+
+// mimewanted tells if the type matches one of the --mime patterns
+func mimewanted(mediatype string) bool {
+	for _, pattern := range mimepatterns {
+		if ok, _ := path.Match(pattern, mediatype); ok {
+			return true
+		}
+	}
+	return false
+}
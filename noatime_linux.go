@@ -0,0 +1,6 @@
+package main
+
+import "syscall"
+
+// Open flag to read a file without updating its access time
+const onoatime = syscall.O_NOATIME
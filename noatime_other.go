@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// Not available on this platform
+const onoatime = 0
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// toomanyfiles tells if err is running out of file descriptors, for the process or the system
+func toomanyfiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// filelimithint says what can be done about running out of file descriptors.
+// Go already raised the soft limit to the hard limit at startup, so it's the
+// hard limit that needs raising.
+func filelimithint(err error) string {
+	if errors.Is(err, syscall.ENFILE) {
+		return fmt.Sprintf("the system has too many files open, raise fs.file-max or use fewer --threads (%v now)", *threads)
+	}
+	var limit syscall.Rlimit
+	if syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit) != nil {
+		return fmt.Sprintf("raise the limit on open files (ulimit -n) or use fewer --threads (%v now)", *threads)
+	}
+	return fmt.Sprintf("this process may open %v files, raise the hard limit (ulimit -Hn, or LimitNOFILE= for a systemd service) or use fewer --threads (%v now)", limit.Cur, *threads)
+}
+
+var filelimitwarning sync.Once
+
+// outoffiles deals with a worker running out of file descriptors: it tells what to
+// do about it once, and with --keep-going lets fewer workers go at the same time
+func outoffiles(err error, gate *workergate) {
+	filelimitwarning.Do(func() {
+		logerror("Ran out of file descriptors: %s", filelimithint(err))
+	})
+	if !*keepgoing || gate == nil {
+		return
+	}
+	gate.Lock()
+	limit, active := gate.limit, gate.active
+	gate.Unlock()
+	// More than the limit are still at work when the last time hasn't sunk in yet
+	if limit > 1 && active <= limit {
+		gate.setlimit(limit / 2)
+		log("Going down to %v threads, as there are not enough file descriptors for more", gate.getlimit())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Only files owned by these are processed, -1 means anyone
+var owneruid, ownergid int64 = -1, -1
+
+// parseowner turns a --owner value into a uid, numbers are taken as is
+func parseowner(value string) (int64, error) {
+	if id, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return int64(id), nil
+	}
+	u, err := user.Lookup(value)
+	if err != nil {
+		return -1, fmt.Errorf("Unknown owner %s: %v", value, err)
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return -1, fmt.Errorf("Owner %s has uid %s, which is not a number", value, u.Uid)
+	}
+	return int64(id), nil
+}
+
+// parsegroup turns a --group value into a gid, numbers are taken as is
+func parsegroup(value string) (int64, error) {
+	if id, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return int64(id), nil
+	}
+	g, err := user.LookupGroup(value)
+	if err != nil {
+		return -1, fmt.Errorf("Unknown group %s: %v", value, err)
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return -1, fmt.Errorf("Group %s has gid %s, which is not a number", value, g.Gid)
+	}
+	return int64(id), nil
+}
+
+// wrongowner returns why the file is left alone by --owner or --group, or "" if it isn't
+func wrongowner(sysstat *syscall.Stat_t) string {
+	if owneruid >= 0 && int64(sysstat.Uid) != owneruid {
+		return fmt.Sprintf("owned by uid %v, not %v", sysstat.Uid, owneruid)
+	}
+	if ownergid >= 0 && int64(sysstat.Gid) != ownergid {
+		return fmt.Sprintf("in group gid %v, not %v", sysstat.Gid, ownergid)
+	}
+	return ""
+}
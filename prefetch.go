@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// How many files --prefetch warms the cache for ahead of the threads, 0 for off
+var prefetch *int
+
+var prefetchtime atomic.Int64
+
+// startprefetch passes the files from queue on to the workers through the returned
+// queue, first asking for the first record of each to be read into the cache. That
+// queue holds depth files, so by the time a worker gets to one its first read is done,
+// instead of every worker waiting out the latency of the storage on its own.
+func startprefetch(queue <-chan queueItem, depth int, db *badger.DB) <-chan queueItem {
+	warmed := make(chan queueItem, depth)
+	go func() {
+		for item := range queue {
+			if stopped() == nil {
+				start := time.Now()
+				if prefetchworthy(&item, db) {
+					warm(item.fp, recordsize)
+				}
+				timed(&prefetchtime, start)
+			}
+			warmed <- item
+		}
+		close(warmed)
+	}()
+	return warmed
+}
+
+// prefetchworthy runs the checks of processfile that don't read the file, so what
+// they skip anyway isn't read ahead, like the files a resumed run has done already.
+// The stat is kept in the item for processfile, which then doesn't do it again.
+func prefetchworthy(item *queueItem, db *badger.DB) bool {
+	if item.info == nil {
+		info, err := item.fi.Info()
+		if err != nil {
+			// processfile tells about it
+			return false
+		}
+		item.info = info
+	}
+	if item.forced {
+		return true
+	}
+	if item.info.Size() <= *minfilesize || ignoredsuffix(item.fp) != "" {
+		return false
+	}
+	sysstat, ok := item.info.Sys().(*syscall.Stat_t)
+	if !ok || wrongowner(sysstat) != "" {
+		return false
+	}
+	if db != nil {
+		entry, found, err := resumeget(db, statfileid(sysstat))
+		if err == nil && found && !stale(item.info, entry.recompressed) && entry.matches(item.info) {
+			return false
+		}
+	}
+	return true
+}
+
+// warm gets the first length bytes of the file going into the cache, errors are
+// left for the worker to run into
+func warm(fp string, length int64) {
+	f, err := opensource(fp)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err = willneed(f, length); err != nil {
+		debug("Failed to prefetch %s: %v", fp, err)
+	}
+}
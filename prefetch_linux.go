@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// willneed starts reading the range into the cache in the background
+func willneed(f *os.File, length int64) error {
+	return unix.Fadvise(int(f.Fd()), 0, length, unix.FADV_WILLNEED)
+}
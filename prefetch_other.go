@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// No fadvise here, so read the first record and let the cache keep it
+func willneed(f *os.File, length int64) error {
+	buffer := make([]byte, min(length, holesize))
+	if _, err := f.ReadAt(buffer, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
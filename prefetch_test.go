@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// The files processfile skips without reading them aren't read ahead either
+func TestPrefetchWorthy(t *testing.T) {
+	testflags(t, "--prefetch", "16")
+	db, err := openresume("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dir := t.TempDir()
+	item := func(name string, size int) queueItem {
+		fp := filepath.Join(dir, name)
+		writefile(t, fp, size, []byte("some text\n"))
+		info, err := os.Lstat(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return queueItem{fp: fp, fi: fs.FileInfoToDirEntry(info)}
+	}
+
+	handled := item("handled.txt", 64<<10)
+	info, _ := handled.fi.Info()
+	if err := resumeput(db, statfileid(info.Sys().(*syscall.Stat_t)), resumeentry{size: info.Size(), mtime: info.ModTime().UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+	forced := item("forced.txt", 100)
+	forced.forced = true
+	for name, c := range map[string]struct {
+		item queueItem
+		want bool
+	}{
+		"due":       {item("due.txt", 64<<10), true},
+		"too small": {item("small.txt", 100), false},
+		"ignored":   {item("archive.gz", 64<<10), false},
+		"handled":   {handled, false},
+		"forced":    {forced, true},
+	} {
+		if got := prefetchworthy(&c.item, db); got != c.want {
+			t.Errorf("prefetchworthy for a %s file = %v, want %v", name, got, c.want)
+		}
+		if c.item.info == nil {
+			t.Errorf("The stat of a %s file isn't kept for processfile", name)
+		}
+	}
+}
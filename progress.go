@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Key the progress counters are kept under in the resume database, inode keys are 8 or 16 bytes long
+var progresskey = []byte("zir-progress")
+
+// progress is what has been done so far, kept across restarts of the same job
+type progress struct {
+	files, bytes, notsmaller, saved uint64
+}
+
+func currentprogress() progress {
+	return progress{totalfiles.Load(), totalbytes.Load(), notsmallerfiles.Load(), savedbytes.Load()}
+}
+
+func (p progress) minus(o progress) progress {
+	return progress{p.files - o.files, p.bytes - o.bytes, p.notsmaller - o.notsmaller, p.saved - o.saved}
+}
+
+// What earlier runs of the job did, it's in the totals but not in the rates
+var resumedfiles, resumedbytes atomic.Uint64
+
+// addtototals puts progress from an earlier run into the counters for the summary
+func (p progress) addtototals() {
+	resumedfiles.Add(p.files)
+	resumedbytes.Add(p.bytes)
+	totalfiles.Add(p.files)
+	totalbytes.Add(p.bytes)
+	notsmallerfiles.Add(p.notsmaller)
+	savedbytes.Add(p.saved)
+}
+
+func encodeprogress(p progress) []byte {
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint64(b[0:], p.files)
+	binary.LittleEndian.PutUint64(b[8:], p.bytes)
+	binary.LittleEndian.PutUint64(b[16:], p.notsmaller)
+	binary.LittleEndian.PutUint64(b[24:], p.saved)
+	return b
+}
+
+func decodeprogress(val []byte) (progress, bool) {
+	if len(val) != 32 {
+		return progress{}, false
+	}
+	return progress{
+		binary.LittleEndian.Uint64(val[0:]),
+		binary.LittleEndian.Uint64(val[8:]),
+		binary.LittleEndian.Uint64(val[16:]),
+		binary.LittleEndian.Uint64(val[24:]),
+	}, true
+}
+
+// loadprogress returns the progress saved by earlier runs, if any
+func loadprogress(db *badger.DB) (p progress, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(progresskey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			p, _ = decodeprogress(val)
+			return nil
+		})
+	})
+	return p, err
+}
+
+func saveprogress(db *badger.DB, p progress) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(progresskey, encodeprogress(p))
+	})
+}
+
+// clearprogress forgets the progress of a job that got through everything, for a
+// database that is kept for the next run
+func clearprogress(db *badger.DB) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(progresskey)
+	})
+}
+
+// checkpoint saves the progress of this job every interval, until stop is closed.
+// base is what the counters were at when this job started, before adding what earlier runs did.
+func checkpoint(db *badger.DB, base progress, live func() progress, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := saveprogress(db, live().minus(base)); err != nil {
+				logerror("Failed to save progress to the resume database: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// A kept resume database must not carry the totals of a finished job into the next one
+func TestProgressResetWhenDatabaseKept(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 3; i++ {
+		writefile(t, filepath.Join(root, "file"+string(rune('a'+i))+".txt"), 64<<10, []byte("some text to compress\n"))
+	}
+	dbpath := filepath.Join(t.TempDir(), "resume")
+	for run := 0; run < 2; run++ {
+		testflags(t, "--noresume=false", "--persistent-resume", "--checkpoint-interval", "1ms")
+		if err := recompress(root, dbpath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := openresume(dbpath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	saved, err := loadprogress(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != (progress{}) {
+		t.Errorf("Progress of the finished job left in the resume database: %+v", saved)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/spf13/pflag"
+)
+
+// Datasets can be configured with ZFS user properties starting with this, like zfs set zir:ignore=iso,img tank/media
+const propertyprefix = "zir:"
+
+// applyproperties picks up the options set as user properties on the dataset,
+// anything given on the command line wins. The returned function puts the
+// options back like they were, for the next dataset.
+func applyproperties(name string) (restore func()) {
+	oldignore, oldskipratio, oldfsync, oldrecordsize := ignorelist, *skipratio, *fsync, recordsize
+	restore = func() {
+		ignorelist, *skipratio, *fsync, recordsize = oldignore, oldskipratio, oldfsync, oldrecordsize
+	}
+
+	// Copies go a whole number of records at a time
+	if value, err := zfsget(name, "recordsize"); err == nil {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > 0 {
+			debug("Dataset %s has a recordsize of %v bytes", name, size)
+			recordsize = size
+		}
+	} else {
+		debug("Could not read the recordsize of dataset %s, going with %v bytes: %v", name, recordsize, err)
+	}
+
+	if *fsync {
+		// ZFS ignores fsync on these, so don't bother
+		if value, err := zfsget(name, "sync"); err == nil && value == "disabled" {
+			log("Dataset %s has sync=disabled, not doing --fsync there as it would not make anything safer", name)
+			*fsync = false
+		}
+	}
+
+	if !pflag.CommandLine.Changed("ignore") && !pflag.CommandLine.Changed("no-ignore") {
+		if value, found := userproperty(name, "ignore"); found {
+			extra := parseignore(value)
+			debug("Dataset %s also ignores %v", name, extra)
+			ignorelist = append(append([]string{}, ignorelist...), extra...)
+		}
+	}
+
+	if !pflag.CommandLine.Changed("skipratio") && !pflag.CommandLine.Changed("target-algorithm") && !pflag.CommandLine.Changed("no-skip-compressed") {
+		if value, found := userproperty(name, "skip-ratio"); found {
+			ratio, err := strconv.ParseFloat(value, 64)
+			if err != nil || ratio < 0 {
+				logerror("Ignoring %sskip-ratio %q on dataset %s, it is not a valid ratio", propertyprefix, value, name)
+			} else {
+				debug("Dataset %s uses skip ratio %v", name, ratio)
+				*skipratio = ratio
+			}
+		}
+	}
+
+	return restore
+}
+
+// userproperty returns the value of a zir: user property, found is false if it isn't set
+func userproperty(name, property string) (value string, found bool) {
+	value, err := zfsget(name, propertyprefix+property)
+	if err != nil {
+		debug("Could not read %s%s of dataset %s: %v", propertyprefix, property, name, err)
+		return "", false
+	}
+	// zfs shows unset user properties as a dash
+	if value == "-" || value == "" {
+		return "", false
+	}
+	return value, true
+}
+
+// sharedblocks warns when files in the dataset may share blocks through dedup
+// or block cloning, as rewriting them gives each file its own copy and uses
+// more space instead of less. Returns true if the dataset should be skipped.
+func sharedblocks(name string) bool {
+	if cloned, err := poolclonedbytes(poolname(name)); err == nil && cloned > 0 {
+		logerror("Pool %s has %v bytes of cloned blocks, rewriting a cloned file gives it its own copy of them", poolname(name), cloned)
+	}
+	dedup, err := zfsget(name, "dedup")
+	if err != nil || dedup == "off" {
+		return false
+	}
+	if *skipdedup {
+		log("Skipping dataset %s, it has dedup=%s and rewriting deduplicated files can use more space (--skip-dedup)", name, dedup)
+		return true
+	}
+	logerror("Dataset %s has dedup=%s, rewritten files that were deduplicated will use more space, see --skip-dedup", name, dedup)
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// What each device found in the walk is, so statfs runs once per filesystem
+var pseudodevs = struct {
+	sync.Mutex
+	names map[uint64]string
+}{names: map[uint64]string{}}
+
+// pseudofsdir returns the kind of pseudo filesystem, like proc or sysfs, the directory is the
+// mountpoint of, or an empty string. Only directories on another device than rootdev are
+// looked at, as those are where the walk crosses into a mount.
+func pseudofsdir(fp string, di os.DirEntry, rootdev uint64) string {
+	if !di.IsDir() {
+		return ""
+	}
+	fileinfo, err := di.Info()
+	if err != nil {
+		return ""
+	}
+	dev := uint64(fileinfo.Sys().(*syscall.Stat_t).Dev)
+	if dev == rootdev {
+		return ""
+	}
+	pseudodevs.Lock()
+	defer pseudodevs.Unlock()
+	name, ok := pseudodevs.names[dev]
+	if !ok {
+		name = pseudofs(fp)
+		pseudodevs.names[dev] = name
+	}
+	return name
+}
+
+// warnpseudofs complains when asked to process a pseudo filesystem itself, that is
+// not what anyone means to do
+func warnpseudofs(root string) {
+	if name := pseudofs(root); name != "" {
+		logerror("WARNING: %s is on a %s filesystem, which holds no data worth recompressing and rewriting its files may do harm. Did you mean to point at another path?", root, name)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "syscall"
+
+// The statfs magic numbers of filesystems that don't store files on a disk
+var pseudofsmagic = map[uint32]string{
+	0x9fa0:     "proc",
+	0x62656572: "sysfs",
+	0x01021994: "tmpfs", // devtmpfs too
+	0x27e0eb:   "cgroup",
+	0x63677270: "cgroup2",
+	0x1cd1:     "devpts",
+	0x64626720: "debugfs",
+	0x74726163: "tracefs",
+	0x73636673: "securityfs",
+	0xcafe4a11: "bpf",
+	0x6165676c: "pstore",
+	0xde5e81e4: "efivarfs",
+	0x19800202: "mqueue",
+}
+
+// pseudofs returns the kind of pseudo filesystem fp is on, or an empty string
+func pseudofs(fp string) string {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(fp, &st); err != nil {
+		return ""
+	}
+	return pseudofsmagic[uint32(st.Type)]
+}
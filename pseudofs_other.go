@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Not known on this platform
+func pseudofs(fp string) string {
+	return ""
+}
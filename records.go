@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
+)
+
+// The recordsize of the dataset being processed, the default until it's known
+var recordsize int64 = holesize
+
+// The least ZFS allocates for a record with data in it, a sector on the 4K sector
+// drives pools are made of nowadays. Smaller data is embedded, but that's < 112 bytes.
+const minsector = 4096
+
+var skipminimal *bool
+
+var minimalfiles atomic.Uint64
+
+// minimalondisk tells if the file is a single record that uses no more than a sector
+// already. No compression gets it smaller, so rewriting it would only cost IO. A file
+// of more records could be that small because it is mostly holes, with the records
+// that do have data still compressing better, so those are never taken for minimal.
+func minimalondisk(size, ondisk int64) bool {
+	return size > 0 && size <= recordsize && ondisk <= minsector
+}
+
+// recordbuffer returns a copy buffer of about size bytes holding whole records,
+// so every read and write starts on a record boundary. When size is less than a
+// record there's no helping it, and the buffer is used as it is.
+func recordbuffer(size int32) []byte {
+	if int64(size) >= recordsize {
+		size = int32(int64(size) / recordsize * recordsize)
+	}
+	return make([]byte, size)
+}
+
+// copyrecords copies src to dst a full buffer at a time. Unlike io.CopyBuffer it
+// really uses the buffer, where that hands over to the files themselves when it
+// can, and they copy in 32 KiB chunks or even let the filesystem clone the blocks.
+// A read interrupted by a signal is tried again, os.File does that itself but other
+// readers may pass EINTR on.
+func copyrecords(dst io.Writer, src io.Reader, buffer []byte) (int64, error) {
+	var copied int64
+	for {
+		n, err := io.ReadFull(src, buffer)
+		copiedbytes.Add(uint64(n))
+		if n > 0 {
+			written, werr := dst.Write(buffer[:n])
+			copied += int64(written)
+			if werr != nil {
+				return copied, werr
+			}
+			if written != n {
+				return copied, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return copied, nil
+		}
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return copied, err
+		}
+	}
+}
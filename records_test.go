@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMinimalOnDisk(t *testing.T) {
+	saved := recordsize
+	recordsize = 128 << 10
+	t.Cleanup(func() { recordsize = saved })
+	for _, c := range []struct {
+		size, ondisk int64
+		want         bool
+	}{
+		{0, 0, false},
+		{20 << 10, 4096, true},
+		{20 << 10, 8192, false},
+		{128 << 10, 4096, true},
+		// Sparse, the records with data could still compress better
+		{1 << 30, 4096, false},
+		{1 << 30, 8192 * 4096, false},
+	} {
+		if got := minimalondisk(c.size, c.ondisk); got != c.want {
+			t.Errorf("minimalondisk(%v, %v) = %v, want %v", c.size, c.ondisk, got, c.want)
+		}
+	}
+}
+
+// eintrreader fails the first read with EINTR, like a raw read interrupted by a signal
+type eintrreader struct {
+	io.Reader
+	interrupted bool
+}
+
+func (r *eintrreader) Read(p []byte) (int, error) {
+	if !r.interrupted {
+		r.interrupted = true
+		return 0, syscall.EINTR
+	}
+	return r.Reader.Read(p)
+}
+
+// copyrecords tries a read interrupted with EINTR again, and copies everything
+func TestCopyRecordsEINTR(t *testing.T) {
+	data := bytes.Repeat([]byte("some data\n"), 1000)
+	var dst bytes.Buffer
+	copied, err := copyrecords(&dst, &eintrreader{Reader: bytes.NewReader(data)}, make([]byte, 4096))
+	if err != nil {
+		t.Fatalf("copyrecords failed on EINTR: %v", err)
+	}
+	if copied != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+		t.Errorf("Copied %v bytes after EINTR, want all %v", copied, len(data))
+	}
+}
+
+// os.File does retry on EINTR, so a copy from a blocking descriptor doesn't fail
+// while signals keep coming in
+func TestCopyRecordsSignals(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	// Blocking descriptors, so the reads wait in the kernel where signals interrupt them
+	src := os.NewFile(uintptr(fds[0]), "pipe")
+	defer src.Close()
+	sink := os.NewFile(uintptr(fds[1]), "pipe")
+
+	const chunks = 50
+	chunk := bytes.Repeat([]byte("x"), 1000)
+	go func() {
+		for i := 0; i < chunks; i++ {
+			syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+			time.Sleep(time.Millisecond)
+			sink.Write(chunk)
+		}
+		sink.Close()
+	}()
+	copied, err := copyrecords(io.Discard, src, make([]byte, 64<<10))
+	if err != nil || copied != chunks*int64(len(chunk)) {
+		t.Errorf("copyrecords = %v, %v, want %v bytes", copied, err, chunks*len(chunk))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "sync"
+
+// reorderwindow is for --randomize-order: it holds the last files the walk found, and
+// hands them out in random order. That spreads the work over more directories at once
+// without keeping the whole tree in memory like --shuffle does.
+type reorderwindow struct {
+	lock  sync.Mutex
+	items []queueItem
+	size  int
+}
+
+// add puts the item in the window, and once that is full takes out a random one to process now
+func (w *reorderwindow) add(item queueItem) (queueItem, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.items) < w.size {
+		w.items = append(w.items, item)
+		return queueItem{}, false
+	}
+	samplelock.Lock()
+	i := sampler.Intn(len(w.items))
+	samplelock.Unlock()
+	out := w.items[i]
+	w.items[i] = item
+	return out, true
+}
+
+// drain returns what is left in the window once the walk is done, in random order
+func (w *reorderwindow) drain() []queueItem {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	items := w.items
+	w.items = nil
+	samplelock.Lock()
+	sampler.Shuffle(len(items), func(i, j int) {
+		items[i], items[j] = items[j], items[i]
+	})
+	samplelock.Unlock()
+	return items
+}
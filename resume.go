@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+)
+
+// How much Badger gets to do in the background. Its defaults are for a database that
+// is the main thing running, here it's the bookkeeping next to the copying.
+var resumecompactors *int
+var resumememtable uint64
+var resumememtablevalue *string // as given, for messages
+
+// With --resume-unsafe-fast writes to the resume database aren't synced to disk
+var resumeunsafefast *bool
+
+// With --persistent-resume the database is kept after a run that got through
+// everything, so the next run goes straight past the files that didn't change
+var persistentresume *bool
+
+// openresume opens the resume database, an empty path keeps it in memory only.
+// Badger's defaults are for big values, but entries here are a 16 byte key with
+// at most 58 bytes of value. Those all stay in the tables, so the value log is
+// kept small. The database is on a dataset that compresses already, so Badger
+// doesn't compress too. That lets tables be read straight from the page cache,
+// without a block cache of its own.
+func openresume(dbpath string, readonly bool) (*badger.DB, error) {
+	opts := badger.DefaultOptions(dbpath).
+		WithNumCompactors(*resumecompactors).
+		WithMemTableSize(int64(resumememtable)).
+		WithValueThreshold(1 << 10).
+		WithValueLogFileSize(16 << 20).
+		WithCompression(options.None).
+		WithBlockCacheSize(0).
+		WithMetricsEnabled(false).
+		WithDetectConflicts(false).
+		WithSyncWrites(!*resumeunsafefast)
+	if dbpath == "" {
+		opts = opts.WithInMemory(true)
+	} else if readonly {
+		opts = opts.WithReadOnly(true)
+	}
+	return badger.Open(opts)
+}
+
+// resumeentry is what the resume database remembers about a handled inode
+type resumeentry struct {
+	legacy       bool // old style "handled" marker without any metadata
+	size         int64
+	mtime        int64      // unix nanoseconds
+	recompressed int64      // unix nanoseconds, when we last recompressed it, 0 if not known
+	action       fileaction // what came of that, rewritten or kept as the copy wasn't smaller
+	hash         []byte     // sha256 of the contents, only stored with --checksum-cache
+}
+
+// matches returns true if the file still looks like it did when it was handled
+func (e resumeentry) matches(fileinfo os.FileInfo) bool {
+	return e.legacy || (e.size == fileinfo.Size() && e.mtime == fileinfo.ModTime().UnixNano())
+}
+
+// resumekey is the device followed by the inode number
+func resumekey(id fileid) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint64(b[0:], id.dev)
+	binary.LittleEndian.PutUint64(b[8:], id.ino)
+	return b
+}
+
+// The current layout of resume entries, in their first byte: version, action, size,
+// mtime and recompress time, then the hash if there is one
+const resumeentryversion = 1
+
+func encoderesumeentry(e resumeentry) []byte {
+	b := make([]byte, 26, 26+len(e.hash))
+	b[0] = resumeentryversion
+	b[1] = byte(e.action)
+	binary.LittleEndian.PutUint64(b[2:], uint64(e.size))
+	binary.LittleEndian.PutUint64(b[10:], uint64(e.mtime))
+	binary.LittleEndian.PutUint64(b[18:], uint64(e.recompressed))
+	return append(b, e.hash...)
+}
+
+// decoderesumeentry reads the current layout, and the ones from before it had a
+// version which are told apart by their length
+func decoderesumeentry(val []byte) (resumeentry, bool) {
+	if string(val) == "handled" {
+		return resumeentry{legacy: true}, true
+	}
+	var e resumeentry
+	var rest []byte
+	switch len(val) {
+	case 26, 26 + sha256.Size:
+		if val[0] != resumeentryversion {
+			return resumeentry{}, false
+		}
+		e.action = fileaction(val[1])
+		e.size = int64(binary.LittleEndian.Uint64(val[2:]))
+		e.mtime = int64(binary.LittleEndian.Uint64(val[10:]))
+		e.recompressed = int64(binary.LittleEndian.Uint64(val[18:]))
+		rest = val[26:]
+	case 16, 16 + sha256.Size, 24, 24 + sha256.Size:
+		// Size and mtime, the recompress time if the length says so, and the hash
+		e.size = int64(binary.LittleEndian.Uint64(val[0:]))
+		e.mtime = int64(binary.LittleEndian.Uint64(val[8:]))
+		rest = val[16:]
+		if len(val) == 24 || len(val) == 24+sha256.Size {
+			e.recompressed = int64(binary.LittleEndian.Uint64(val[16:]))
+			e.action = actionrewritten
+			rest = val[24:]
+		}
+	default:
+		return resumeentry{}, false
+	}
+	if len(rest) > 0 {
+		e.hash = append([]byte{}, rest...)
+	}
+	return e, true
+}
+
+// resumeget looks up the inode, found is false if it's not there or unreadable
+func resumeget(db *badger.DB, id fileid) (entry resumeentry, found bool, err error) {
+	defer timed(&dbtime, time.Now())
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(resumekey(id))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			entry, found = decoderesumeentry(val)
+			return nil
+		})
+	})
+	return entry, found, err
+}
+
+func resumeput(db *badger.DB, id fileid, entry resumeentry) error {
+	defer timed(&dbtime, time.Now())
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(resumekey(id), encoderesumeentry(entry))
+	})
+}
+
+// Key the newest entry version the resume database was written with is kept under
+var formatkey = []byte("zir-format")
+
+// resumeformat returns the entry version the database was written with, 0 if it's from
+// before databases recorded that. A database from a newer version is refused, this one
+// could misread what that wrote.
+func resumeformat(db *badger.DB) (byte, error) {
+	var version byte
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(formatkey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 1 {
+				return fmt.Errorf("unknown format marker %x", val)
+			}
+			version = val[0]
+			return nil
+		})
+	})
+	if err == nil && version > resumeentryversion {
+		err = fmt.Errorf("it was written by a newer version of this tool (entry format %v, this one knows up to %v), remove it or use --noresume", version, resumeentryversion)
+	}
+	return version, err
+}
+
+// migrateresume brings a database from an older version up to date: keys from before
+// they included the device, and entries from before they had a version are rewritten.
+// Those old databases always lived in the directory being processed, so the device of
+// that directory is the best guess there is.
+func migrateresume(db *badger.DB, dev uint64) (int, error) {
+	version, err := resumeformat(db)
+	if err != nil {
+		return 0, err
+	}
+	if version == resumeentryversion {
+		return 0, nil
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	var migrated int
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if len(item.Key()) != 8 && len(item.Key()) != 16 {
+				continue
+			}
+			oldkey := item.KeyCopy(nil)
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			key := oldkey
+			if len(oldkey) == 8 {
+				key = resumekey(fileid{dev, binary.LittleEndian.Uint64(oldkey)})
+				if err = wb.Delete(oldkey); err != nil {
+					return err
+				}
+			}
+			// Entries that can't be read are left, the run looks at those files again
+			newval := val
+			if entry, ok := decoderesumeentry(val); ok && !entry.legacy {
+				newval = encoderesumeentry(entry)
+			}
+			if len(key) == len(oldkey) && bytes.Equal(newval, val) {
+				continue
+			}
+			if err = wb.Set(key, newval); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = wb.Set(formatkey, []byte{resumeentryversion}); err != nil {
+		return 0, err
+	}
+	return migrated, wb.Flush()
+}
+
+// dumpresume prints everything in the resume database, without changing it
+func dumpresume(dbpath string) error {
+	db, err := badger.Open(badger.DefaultOptions(dbpath).WithReadOnly(true).WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var entries, rewritten, kept int
+	var oldest, newest time.Time
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			if string(key) == string(formatkey) {
+				err := item.Value(func(val []byte) error {
+					log("format: entries are version %x", val)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if string(key) == string(progresskey) {
+				err := item.Value(func(val []byte) error {
+					if p, ok := decodeprogress(val); ok {
+						log("progress: %v files, %v bytes processed, %v kept as not smaller, %v bytes freed", p.files, p.bytes, p.notsmaller, p.saved)
+					} else {
+						log("progress: unknown value %x", val)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			var what string
+			switch len(key) {
+			case 8:
+				what = fmt.Sprintf("inode %v (old format without device)", binary.LittleEndian.Uint64(key))
+			case 16:
+				what = fmt.Sprintf("device %v inode %v", binary.LittleEndian.Uint64(key[0:]), binary.LittleEndian.Uint64(key[8:]))
+			default:
+				what = fmt.Sprintf("unknown key %x", key)
+			}
+			err := item.Value(func(val []byte) error {
+				entry, ok := decoderesumeentry(val)
+				if !ok {
+					log("%s: unknown value %x", what, val)
+					return nil
+				}
+				if entry.legacy {
+					log("%s: handled (old format without metadata)", what)
+					return nil
+				}
+				line := fmt.Sprintf("%s: handled, size %v, modified %v", what, entry.size, time.Unix(0, entry.mtime))
+				if entry.recompressed != 0 {
+					recompressed := time.Unix(0, entry.recompressed)
+					if entry.action == actionkept {
+						line += fmt.Sprintf(", recompressed %v but kept as it wasn't smaller", recompressed)
+						kept++
+					} else {
+						line += fmt.Sprintf(", recompressed %v", recompressed)
+						rewritten++
+					}
+					if oldest.IsZero() || recompressed.Before(oldest) {
+						oldest = recompressed
+					}
+					if recompressed.After(newest) {
+						newest = recompressed
+					}
+				}
+				if entry.hash != nil {
+					line += fmt.Sprintf(", checksum %x", entry.hash)
+				}
+				log("%s", line)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			entries++
+		}
+		return nil
+	})
+	log("%v entries in the resume database", entries)
+	if rewritten+kept > 0 {
+		log("%v rewritten and %v kept as the copy wasn't smaller, recompressed between %v and %v", rewritten, kept, oldest, newest)
+	}
+	return err
+}
+
+// compactresume flattens the LSM tree and garbage collects the value log of the resume database
+func compactresume(dbpath string) error {
+	before, err := diskusage(dbpath)
+	if err != nil {
+		return err
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(dbpath).WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		return err
+	}
+	if err = db.Flatten(runtime.NumCPU()); err != nil {
+		db.Close()
+		return err
+	}
+	for {
+		err = db.RunValueLogGC(0.5)
+		if err == badger.ErrNoRewrite {
+			break
+		}
+		if err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if err = db.Close(); err != nil {
+		return err
+	}
+
+	after, err := diskusage(dbpath)
+	if err != nil {
+		return err
+	}
+	log("Resume database used %v bytes before compacting, %v bytes after", before, after)
+	return nil
+}
+
+// diskusage returns the space allocated to all files below root
+func diskusage(root string) (uint64, error) {
+	var total uint64
+	err := filepath.WalkDir(root, func(fp string, di os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if di.Type().IsRegular() {
+			fileinfo, err := di.Info()
+			if err != nil {
+				return err
+			}
+			if sysstat, ok := fileinfo.Sys().(*syscall.Stat_t); ok {
+				total += uint64(sysstat.Blocks) * 512
+			}
+		}
+		return nil
+	})
+	return total, err
+}
+
+// hashfile returns the sha256 of the file contents
+func hashfile(fp string, buffer []byte) ([]byte, error) {
+	defer timed(&copytime, time.Now())
+	f, err := opensource(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = copyrecords(h, f, buffer); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
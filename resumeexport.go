@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// The first line of a --resume-export file
+type exportheader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+const exportformat = "zfs-inplace-recompress resume export"
+
+// exportentry is a handled file by its path and contents instead of its inode,
+// which is different on another machine or after zfs send and receive
+type exportentry struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	Mtime        int64  `json:"mtime_ns"`
+	Recompressed int64  `json:"recompressed_ns,omitempty"`
+	Kept         bool   `json:"kept,omitempty"`
+	SHA256       string `json:"sha256"`
+}
+
+// exportresume writes the files below root that the resume database in dbpath has
+// handled to fp, one JSON line each. Files hashed for --checksum-cache keep that
+// hash, the others are read to get one.
+func exportresume(root, dbpath, fp string) error {
+	db, err := badger.Open(badger.DefaultOptions(dbpath).WithReadOnly(true).WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err = resumeformat(db); err != nil {
+		return err
+	}
+
+	out, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	encoder := json.NewEncoder(w)
+	if err = encoder.Encode(exportheader{exportformat, 1}); err != nil {
+		return err
+	}
+
+	buffer := recordbuffer(*buffersize)
+	seen := map[fileid]bool{}
+	var exported, skipped int
+	err = filepath.WalkDir(root, func(path string, di os.DirEntry, err error) error {
+		if abort.Load() {
+			return errors.New("Aborted due to interrupt")
+		}
+		if err != nil {
+			logerror("Error walking %s, skipping it: %v", path, err)
+			return nil
+		}
+		if strings.HasPrefix(di.Name(), resumedbname) && path != root {
+			if di.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !di.Type().IsRegular() {
+			return nil
+		}
+		fileinfo, err := di.Info()
+		if err != nil {
+			logerror("Error getting info for %s, skipping it: %v", path, err)
+			return nil
+		}
+		id := statfileid(fileinfo.Sys().(*syscall.Stat_t))
+		if seen[id] {
+			// Another link to a file that's exported already
+			return nil
+		}
+		seen[id] = true
+		entry, found, err := resumeget(db, id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		if entry.legacy || !entry.matches(fileinfo) {
+			debug("Not exporting %s, it changed since it was handled", path)
+			skipped++
+			return nil
+		}
+		hash := entry.hash
+		if hash == nil {
+			if hash, err = hashfile(path, buffer); err != nil {
+				logerror("Not exporting %s, reading it failed: %v", path, err)
+				skipped++
+				return nil
+			}
+		}
+		rel, _ := filepath.Rel(root, path)
+		exported++
+		return encoder.Encode(exportentry{
+			Path:         filepath.ToSlash(rel),
+			Size:         entry.size,
+			Mtime:        entry.mtime,
+			Recompressed: entry.recompressed,
+			Kept:         entry.action == actionkept,
+			SHA256:       hex.EncodeToString(hash),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	log("Exported %v handled files to %s, left out %v that changed since", exported, fp, skipped)
+	return out.Close()
+}
+
+// importresume reads a --resume-export file, and adds the files in it to the resume
+// database in dbpath under their inodes here. Only files below root with the same
+// path, size and contents are taken, so nothing is skipped that wasn't handled.
+func importresume(root, dbpath, fp string) error {
+	in, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	decoder := json.NewDecoder(in)
+	var header exportheader
+	if err = decoder.Decode(&header); err != nil {
+		return fmt.Errorf("%s: %w", fp, err)
+	}
+	if header.Format != exportformat {
+		return fmt.Errorf("%s is not a resume export", fp)
+	}
+	if header.Version != 1 {
+		return fmt.Errorf("%s is version %v of the export format, this version only reads 1", fp, header.Version)
+	}
+
+	db, err := openresume(dbpath, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rootinfo, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if _, err = migrateresume(db, uint64(rootinfo.Sys().(*syscall.Stat_t).Dev)); err != nil {
+		return err
+	}
+
+	buffer := recordbuffer(*buffersize)
+	var imported, skipped int
+	for decoder.More() {
+		if abort.Load() {
+			return errors.New("Aborted due to interrupt")
+		}
+		var e exportentry
+		if err = decoder.Decode(&e); err != nil {
+			return fmt.Errorf("%s: %w", fp, err)
+		}
+		want, err := hex.DecodeString(e.SHA256)
+		if err != nil || e.Path == "" || strings.HasPrefix(e.Path, "../") || filepath.IsAbs(e.Path) {
+			return fmt.Errorf("%s: bad entry for %q", fp, e.Path)
+		}
+		path := filepath.Join(root, filepath.FromSlash(e.Path))
+		fileinfo, err := os.Lstat(path)
+		if err != nil || !fileinfo.Mode().IsRegular() || fileinfo.Size() != e.Size {
+			debug("Not importing %s, it is not here or has another size", path)
+			skipped++
+			continue
+		}
+		hash, err := hashfile(path, buffer)
+		if err != nil || !bytes.Equal(hash, want) {
+			debug("Not importing %s, its contents are different", path)
+			skipped++
+			continue
+		}
+		entry := resumeentry{
+			size:         fileinfo.Size(),
+			mtime:        fileinfo.ModTime().UnixNano(),
+			recompressed: e.Recompressed,
+			action:       actionrewritten,
+			hash:         hash,
+		}
+		if e.Kept {
+			entry.action = actionkept
+		}
+		if err = resumeput(db, statfileid(fileinfo.Sys().(*syscall.Stat_t)), entry); err != nil {
+			return err
+		}
+		imported++
+	}
+	log("Imported %v handled files from %s, left out %v that are missing or different here", imported, fp, skipped)
+	return db.Close()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// extensionsavings is what rewriting the files with one extension did to the space they use
+type extensionsavings struct {
+	files         uint64
+	size          uint64
+	before, after int64 // on disk
+}
+
+// A rewritten file whose blocks ZFS hasn't accounted for yet
+type pendingsavings struct {
+	fp, ext string
+	size    uint64
+	before  int64
+}
+
+// How many rewritten files wait for a pool sync before they are stat'ed again
+const savingsbatch = 10000
+
+var savings = struct {
+	sync.Mutex
+	byext   map[string]*extensionsavings
+	pending []pendingsavings
+}{byext: map[string]*extensionsavings{}}
+
+func fileextension(fp string) string {
+	ext := strings.ToLower(filepath.Ext(fp))
+	if ext == "" {
+		ext = "(none)"
+	}
+	return ext
+}
+
+func (s *extensionsavings) add(size uint64, before, after int64) {
+	s.files++
+	s.size += size
+	s.before += before
+	s.after += after
+}
+
+// countsavings adds a rewritten file whose new size on disk is known already
+func countsavings(fp string, size uint64, before, after int64) {
+	addsavings(fileextension(fp), size, before, after)
+}
+
+func addsavings(ext string, size uint64, before, after int64) {
+	savings.Lock()
+	defer savings.Unlock()
+	if savings.byext[ext] == nil {
+		savings.byext[ext] = &extensionsavings{}
+	}
+	savings.byext[ext].add(size, before, after)
+}
+
+// pendsavings adds a file that was just rewritten at written. ZFS only knows how many
+// blocks it takes once the transaction group is synced, so it is looked at again later.
+func pendsavings(fp, written string, size uint64, before int64) {
+	savings.Lock()
+	savings.pending = append(savings.pending, pendingsavings{written, fileextension(fp), size, before})
+	full := len(savings.pending) >= savingsbatch
+	savings.Unlock()
+	if full {
+		settlesavings()
+	}
+}
+
+// settlesavings syncs the pools and counts the pending files with the space they use now
+func settlesavings() {
+	savings.Lock()
+	pending := savings.pending
+	savings.pending = nil
+	savings.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if _, err := zpool("sync"); err != nil {
+		debug("Syncing the pools failed, the savings per extension may be off: %v", err)
+	}
+	for _, p := range pending {
+		fileinfo, err := os.Lstat(p.fp)
+		if err != nil {
+			// Gone already, so there's nothing to tell about it
+			continue
+		}
+		after := fileinfo.Sys().(*syscall.Stat_t).Blocks * 512
+		addsavings(p.ext, p.size, p.before, int64(after))
+	}
+}
+
+// logsavings shows the space freed per extension, those that gained the most first
+func logsavings() {
+	settlesavings()
+	savings.Lock()
+	defer savings.Unlock()
+	if len(savings.byext) == 0 {
+		return
+	}
+	exts := make([]string, 0, len(savings.byext))
+	total := &extensionsavings{}
+	for ext, s := range savings.byext {
+		exts = append(exts, ext)
+		total.files += s.files
+		total.size += s.size
+		total.before += s.before
+		total.after += s.after
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		a, b := savings.byext[exts[i]], savings.byext[exts[j]]
+		if a.before-a.after != b.before-b.after {
+			return a.before-a.after > b.before-b.after
+		}
+		return exts[i] < exts[j]
+	})
+
+	log("Space freed by rewriting, per extension:")
+	log("%-12s %8s %14s %14s %14s %14s %7s", "extension", "files", "bytes", "before", "after", "freed", "freed%")
+	row := func(name string, s *extensionsavings) {
+		percent := "-"
+		if s.before > 0 {
+			percent = fmt.Sprintf("%.1f", 100*float64(s.before-s.after)/float64(s.before))
+		}
+		log("%-12s %8v %14v %14v %14v %14v %7s", name, s.files, s.size, s.before, s.after, s.before-s.after, percent)
+	}
+	for _, ext := range exts {
+		row(ext, savings.byext[ext])
+	}
+	row("all", total)
+}
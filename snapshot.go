@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var excludenewerthansnapshot *bool
+
+// With --exclude-newer-than-snapshot, files changed after this are skipped. Zero means no filter.
+var snapshotcutoff time.Time
+
+// latestsnapshot returns the name and creation time of the newest snapshot of the dataset, an empty name if it has none
+func latestsnapshot(name string) (string, time.Time, error) {
+	lines, err := zfs("list", "-H", "-p", "-t", "snapshot", "-o", "name,creation", "-s", "creation", "-d", "1", name)
+	if err != nil || len(lines) == 0 {
+		return "", time.Time{}, err
+	}
+	fields := strings.Split(lines[len(lines)-1], "\t")
+	if len(fields) != 2 {
+		return "", time.Time{}, fmt.Errorf("unexpected zfs list output %q", lines[len(lines)-1])
+	}
+	created, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unexpected zfs list output %q", lines[len(lines)-1])
+	}
+	return fields[0], time.Unix(created, 0), nil
+}
+
+// setsnapshotcutoff looks up the newest snapshot of the dataset for --exclude-newer-than-snapshot,
+// and returns false if the dataset should be left alone as nothing in it has been snapshotted yet
+func setsnapshotcutoff(name string) bool {
+	snapshotcutoff = time.Time{}
+	if !*excludenewerthansnapshot {
+		return true
+	}
+	snapshot, created, err := latestsnapshot(name)
+	if err != nil {
+		logerror("Skipping dataset %s, failed to find its latest snapshot: %v", name, err)
+		return false
+	}
+	if snapshot == "" {
+		log("Skipping dataset %s, it has no snapshots so everything in it is newer than the latest one", name)
+		return false
+	}
+	log("Only processing files not changed since the latest snapshot %s of %v", snapshot, created.Format(time.RFC3339))
+	snapshotcutoff = created
+	return true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Zero runs at least this long become holes, the default ZFS recordsize
+const holesize = 128 << 10
+
+var zeroes = make([]byte, holesize)
+
+// sparsewriter writes to a new file, but seeks past runs of zeroes instead of
+// writing them, so they end up as holes just like in the original. Call
+// finish when done, so a file ending in a hole gets the right size.
+type sparsewriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (sw *sparsewriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Chunks line up with the records in the file, so whole records become holes
+		chunk := p
+		if n := holesize - int(sw.offset%holesize); len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		if bytes.Equal(chunk, zeroes[:len(chunk)]) {
+			if _, err := sw.f.Seek(int64(len(chunk)), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := sw.f.Write(chunk); err != nil {
+			return written, err
+		}
+		sw.offset += int64(len(chunk))
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (sw *sparsewriter) finish() error {
+	return sw.f.Truncate(sw.offset)
+}
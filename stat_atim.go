@@ -0,0 +1,16 @@
+//go:build linux || openbsd || solaris
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+func statatime(sysstat *syscall.Stat_t) time.Time {
+	return time.Unix(sysstat.Atim.Unix())
+}
+
+func statctime(sysstat *syscall.Stat_t) time.Time {
+	return time.Unix(sysstat.Ctim.Unix())
+}
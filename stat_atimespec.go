@@ -0,0 +1,16 @@
+//go:build darwin || freebsd || netbsd
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+func statatime(sysstat *syscall.Stat_t) time.Time {
+	return time.Unix(sysstat.Atimespec.Unix())
+}
+
+func statctime(sysstat *syscall.Stat_t) time.Time {
+	return time.Unix(sysstat.Ctimespec.Unix())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// workercounters is what one worker has done so far. Only its own worker writes
+// to it, so the hot path doesn't have every thread bumping the same counters.
+// The fields are atomic anyway, so checkpoints can peek at them while running.
+type workercounters struct {
+	files, bytes, skipfiles, skipbytes, notsmaller, saved atomic.Uint64
+	done, handled                                         atomic.Uint64 // for --heartbeat-total
+	errors                                                atomic.Uint64 // files that failed
+	failed                                                atomic.Bool   // an error without --keep-going
+}
+
+// workerstats pads the counters to a whole number of cache lines, so workers next to
+// each other in the slice don't share one
+type workerstats struct {
+	workercounters
+	_ [(64 - unsafe.Sizeof(workercounters{})%64) % 64]byte
+}
+
+// The stats of the workers of the run going on, so stopped() and the error limit see
+// what they hit before it's merged
+var runningstats atomic.Pointer[[]workerstats]
+
+// startstats makes the stats for the workers of a run
+func startstats(threads int) []workerstats {
+	stats := make([]workerstats, threads)
+	runningstats.Store(&stats)
+	return stats
+}
+
+// runningerrors is how many files the workers of the run going on failed on, and
+// whether one of them hit an error that stops the run
+func runningerrors() (errors uint64, failed bool) {
+	stats := runningstats.Load()
+	if stats == nil {
+		return 0, false
+	}
+	for i := range *stats {
+		ws := &(*stats)[i]
+		errors += ws.errors.Load()
+		failed = failed || ws.failed.Load()
+	}
+	return errors, failed
+}
+
+// count adds the result to what this worker did
+func (ws *workerstats) count(r fileresult) {
+	if r.action == actionrewritten || r.action == actionkept {
+		ws.done.Add(uint64(r.size))
+		ws.handled.Add(uint64(r.handled))
+	}
+	switch r.action {
+	case actionrewritten:
+		ws.files.Add(1)
+		ws.bytes.Add(uint64(r.size))
+		if r.saved > 0 {
+			ws.saved.Add(uint64(r.saved))
+		}
+	case actionkept:
+		ws.notsmaller.Add(1)
+		fallthrough
+	case actionskipped:
+		ws.skipfiles.Add(1)
+		ws.skipbytes.Add(uint64(r.size))
+	}
+}
+
+// mergestats adds what the workers did to the totals for the summary, and their
+// errors to fileerrors and globalerror. This is done once after all workers are
+// finished and the checkpoints and heartbeats are stopped, as those add the worker
+// stats to the totals themselves and would count them twice after the merge.
+func mergestats(stats []workerstats) {
+	for i := range stats {
+		ws := &stats[i]
+		totalfiles.Add(ws.files.Load())
+		totalbytes.Add(ws.bytes.Load())
+		skipfiles.Add(ws.skipfiles.Load())
+		skipbytes.Add(ws.skipbytes.Load())
+		notsmallerfiles.Add(ws.notsmaller.Load())
+		savedbytes.Add(ws.saved.Load())
+		fileerrors.Add(ws.errors.Load())
+		if ws.failed.Load() {
+			globalerror.Store(true)
+		}
+	}
+	runningstats.Store(nil)
+}
+
+// liveprogress is the totals plus what the workers have done but not merged yet
+func liveprogress(stats []workerstats) progress {
+	p := currentprogress()
+	for i := range stats {
+		ws := &stats[i]
+		p.files += ws.files.Load()
+		p.bytes += ws.bytes.Load()
+		p.notsmaller += ws.notsmaller.Load()
+		p.saved += ws.saved.Load()
+	}
+	return p
+}
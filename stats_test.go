@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestWorkerStatsCacheLines(t *testing.T) {
+	if size := unsafe.Sizeof(workerstats{}); size%64 != 0 {
+		t.Errorf("workerstats is %v bytes, not a whole number of cache lines", size)
+	}
+}
+
+// Worker errors stop the run while it goes, and end up in the totals once, when merged
+func TestMergeWorkerErrors(t *testing.T) {
+	before := fileerrors.Load()
+	t.Cleanup(func() {
+		fileerrors.Store(before)
+		globalerror.Store(false)
+		runningstats.Store(nil)
+	})
+	stats := startstats(2)
+	stats[0].errors.Add(2)
+	stats[1].errors.Add(1)
+	if errors, failed := runningerrors(); errors != 3 || failed {
+		t.Errorf("runningerrors() = %v, %v before a worker failed", errors, failed)
+	}
+	if err := stopped(); err != nil {
+		t.Errorf("Stopped with only --keep-going errors: %v", err)
+	}
+	stats[1].failed.Store(true)
+	if stopped() == nil {
+		t.Error("Not stopped after a worker failed")
+	}
+	mergestats(stats)
+	if got := fileerrors.Load() - before; got != 3 {
+		t.Errorf("Merged %v errors, want 3", got)
+	}
+	if !globalerror.Load() {
+		t.Error("Worker failure not merged into globalerror")
+	}
+	if errors, _ := runningerrors(); errors != 0 {
+		t.Errorf("Merged stats still counted as running: %v errors", errors)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Temporary files get this name prefix (--temp-prefix), so the walk knows to leave them alone
+var tempprefix = ".zir-tmp-"
+
+// The shortest --temp-prefix allowed, so it can't match the names of files that aren't ours
+const mintempprefix = 4
+
+// How long to wait for ZFS to account for the blocks of a new file
+const blocksettletimeout = 15 * time.Second
+
+// rewritetemp writes a copy of the file next to it, and if the copy uses
+// fewer blocks than the original it replaces the original. Returns the id
+// of whichever file is now at fp, and the space the copy used.
+func rewritetemp(fp string, fileinfo os.FileInfo, sysstat *syscall.Stat_t, buffer []byte, hasher hash.Hash) (id fileid, ondisk int64, smaller bool, err error) {
+	defer timed(&copytime, time.Now())
+	source, err := opensource(fp)
+	if err != nil {
+		return fileid{}, 0, false, err
+	}
+	defer source.Close()
+
+	temp, err := createtemp(filepath.Dir(fp))
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return fileid{}, 0, false, fmt.Errorf("%w: %v", errnotwritable, err)
+		}
+		return fileid{}, 0, false, err
+	}
+	defer func() {
+		// Closing twice is harmless, and the temp file goes unless it replaced the original
+		temp.Close()
+		if !smaller || err != nil {
+			os.Remove(temp.Name())
+		}
+	}()
+
+	// Zeroes become holes again, instead of blocks of zeroes if compression is off
+	sw := &sparsewriter{f: temp}
+	writers := []io.Writer{sw}
+	if hasher != nil {
+		writers = append(writers, hasher)
+	}
+	var sourcehash hash.Hash
+	if *verifycopies {
+		sourcehash = sha256.New()
+		writers = append(writers, sourcehash)
+	}
+	copied, err := copyrecords(io.MultiWriter(writers...), source, buffer)
+	if err != nil {
+		return fileid{}, 0, false, err
+	}
+	if err = sw.finish(); err != nil {
+		return fileid{}, 0, false, err
+	}
+	if err = checkcopied(fp, copied, sysstat.Size); err != nil {
+		return fileid{}, 0, false, err
+	}
+	if err = temp.Sync(); err != nil {
+		return fileid{}, 0, false, err
+	}
+
+	tempstat, err := settledstat(temp, sysstat.Size)
+	if err != nil {
+		return fileid{}, 0, false, err
+	}
+	debug("Recompressed copy of %s uses %v bytes (was %v bytes)", fp, tempstat.Blocks*512, sysstat.Blocks*512)
+	if tempstat.Blocks >= sysstat.Blocks {
+		return statfileid(sysstat), int64(tempstat.Blocks) * 512, false, nil
+	}
+	if sourcehash != nil {
+		if err = verifycopy(temp, sourcehash.Sum(nil), buffer); err != nil {
+			return fileid{}, 0, false, err
+		}
+	}
+
+	// Make the copy look like the original, owner first as chown clears setuid bits. Only
+	// root can give files away, and the copy can't replace a file of someone else without.
+	if err = temp.Chown(int(sysstat.Uid), int(sysstat.Gid)); err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return fileid{}, 0, false, fmt.Errorf("%w: %v", errnotwritable, err)
+		}
+		return fileid{}, 0, false, err
+	}
+	if err = temp.Chmod(fileinfo.Mode()); err != nil {
+		return fileid{}, 0, false, err
+	}
+	if err = copyxattrs(fp, temp.Name()); err != nil {
+		return fileid{}, 0, false, fmt.Errorf("copying extended attributes: %w", err)
+	}
+	if err = temp.Close(); err != nil {
+		return fileid{}, 0, false, err
+	}
+	if err = os.Chtimes(temp.Name(), statatime(sysstat), fileinfo.ModTime()); err != nil {
+		return fileid{}, 0, false, err
+	}
+	if err = os.Rename(temp.Name(), fp); err != nil {
+		return fileid{}, 0, false, err
+	}
+	if *fsync {
+		// The rename only sticks after a crash once the directory is on disk too
+		if err := syncdir(filepath.Dir(fp)); err != nil {
+			logerror("Failed to flush directory of %s to disk: %v", fp, err)
+		}
+	}
+	return statfileid(tempstat), int64(tempstat.Blocks) * 512, true, nil
+}
+
+// verifycopy reads the copy back from the start, and checks it has the checksum of the original
+func verifycopy(temp *os.File, want []byte, buffer []byte) error {
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	readback := sha256.New()
+	if _, err := copyrecords(readback, temp, buffer); err != nil {
+		return err
+	}
+	if !bytes.Equal(readback.Sum(nil), want) {
+		return errors.New("the copy reads back different from the original, leaving the original alone")
+	}
+	return nil
+}
+
+func syncdir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// settledstat returns the stat of a freshly written file of size bytes. ZFS only
+// accounts for new data when the transaction group is synced, until then a file
+// shows up as using a single block - so give it a moment to catch up. A file of
+// one record may really use a single block, and one with none is all holes, so
+// those aren't waited for.
+func settledstat(f *os.File, size int64) (*syscall.Stat_t, error) {
+	deadline := time.Now().Add(blocksettletimeout)
+	for {
+		fileinfo, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		sysstat, ok := fileinfo.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil, fmt.Errorf("unknown file type %T", fileinfo.Sys())
+		}
+		if sysstat.Blocks != 1 || size <= recordsize || time.Now().After(deadline) {
+			return sysstat, nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// mirrorfile writes a copy of the file to the same relative path below
+// --mirror-to, so it gets compressed with the settings of the dataset there.
+// The original is left alone.
+func mirrorfile(fp string, fileinfo os.FileInfo, sysstat *syscall.Stat_t, buffer []byte, hasher hash.Hash) (err error) {
+	defer timed(&copytime, time.Now())
+	source, err := opensource(fp)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target := filepath.Join(*mirrorto, fp)
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	temp, err := createtemp(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		temp.Close()
+		if err != nil {
+			os.Remove(temp.Name())
+		}
+	}()
+
+	sw := &sparsewriter{f: temp}
+	var w io.Writer = sw
+	if hasher != nil {
+		w = io.MultiWriter(sw, hasher)
+	}
+	copied, err := copyrecords(w, source, buffer)
+	if err != nil {
+		return err
+	}
+	if err = sw.finish(); err != nil {
+		return err
+	}
+	if err = checkcopied(fp, copied, sysstat.Size); err != nil {
+		return err
+	}
+	if *fsync {
+		if err = temp.Sync(); err != nil {
+			return err
+		}
+	}
+	if copystat, err := temp.Stat(); err == nil {
+		debug("Copy of %s in the mirror uses %v bytes (original uses %v bytes)", fp, copystat.Sys().(*syscall.Stat_t).Blocks*512, sysstat.Blocks*512)
+	}
+
+	// Only root can give files away, everyone else gets copies they own
+	if err = temp.Chown(int(sysstat.Uid), int(sysstat.Gid)); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	if err = temp.Chmod(fileinfo.Mode()); err != nil {
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(temp.Name(), statatime(sysstat), fileinfo.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), target)
+}
+
+// createtemp makes a temporary file in dir, which keeps it on the same dataset so the rename
+// is atomic. The pid in the name tells other runs whether whoever made it is still around.
+func createtemp(dir string) (*os.File, error) {
+	return os.CreateTemp(dir, fmt.Sprintf("%s%d-*", tempprefix, os.Getpid()))
+}
+
+// orphanedtemp returns true if the temporary file was left behind by a run that is gone.
+// Only names exactly like the ones createtemp makes count, <prefix><pid>-<random>, so a
+// file that merely starts with the prefix is never removed, however old it is.
+func orphanedtemp(name string) bool {
+	rest, found := strings.CutPrefix(name, tempprefix)
+	if !found {
+		return false
+	}
+	pidtext, random, found := strings.Cut(rest, "-")
+	if !found || !alldigits(pidtext) || !alldigits(random) {
+		return false
+	}
+	pid, err := strconv.Atoi(pidtext)
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	return errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
+}
+
+// alldigits tells if text is a non-empty run of decimal digits, like the pid and
+// the random part os.CreateTemp puts in a name
+func alldigits(text string) bool {
+	if text == "" {
+		return false
+	}
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checktempprefix makes sure --temp-prefix can only match names createtemp makes:
+// a file name, long enough to be distinctive, that ends in a separator so the pid
+// can't run into it
+func checktempprefix(prefix string) error {
+	if strings.ContainsRune(prefix, '/') {
+		return fmt.Errorf("--temp-prefix %q must be a file name, not a path", prefix)
+	}
+	if len(prefix) < mintempprefix {
+		return fmt.Errorf("--temp-prefix %q is too short, it needs at least %d characters", prefix, mintempprefix)
+	}
+	if !strings.ContainsAny(prefix[len(prefix)-1:], "-_.") {
+		return fmt.Errorf("--temp-prefix %q must end in -, _ or .", prefix)
+	}
+	return nil
+}
+
+// removeorphan deletes a temporary file found by the walk if the run that made it is gone,
+// unless --keep-orphans asks to leave them for a closer look
+func removeorphan(fp string, di os.DirEntry) {
+	if *keeporphans {
+		debug("Leaving temporary file %s alone", fp)
+		return
+	}
+	if !orphanedtemp(di.Name()) {
+		return
+	}
+	if *dryrun != "" {
+		log("Would remove %s, left behind by an earlier run", fp)
+		return
+	}
+	if err := os.Remove(fp); err != nil {
+		logerror("Failed to remove %s, left behind by an earlier run: %v", fp, err)
+		return
+	}
+	orphansremoved.Add(1)
+	log("Removed %s, left behind by an earlier run", fp)
+}
+
+// cleanorphans removes the temporary files left behind below dir, for places the walk
+// doesn't go itself, like the --mirror-to directory
+func cleanorphans(dir string) error {
+	return filepath.WalkDir(dir, func(fp string, di os.DirEntry, err error) error {
+		if err != nil {
+			if fp == dir {
+				return err
+			}
+			debug("Not looking for temporary files in %s: %v", fp, err)
+			return nil
+		}
+		if di.IsDir() && strings.HasPrefix(di.Name(), resumedbname) {
+			return filepath.SkipDir
+		}
+		if di.Type().IsRegular() && strings.HasPrefix(di.Name(), tempprefix) {
+			removeorphan(fp, di)
+		}
+		return nil
+	})
+}
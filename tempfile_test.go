@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOrphanedTemp(t *testing.T) {
+	// A pid that can't be running, above the kernel's pid_max limit
+	const gone = 1 << 23
+	for name, want := range map[string]bool{
+		fmt.Sprintf("%s%d-123456", tempprefix, gone):        true,
+		fmt.Sprintf("%s%d-123456", tempprefix, os.Getpid()): false,
+		fmt.Sprintf("%s%d-123456", tempprefix, 1):           false,
+		fmt.Sprintf("%s%d-", tempprefix, gone):              false,
+		fmt.Sprintf("%s%d-12ab", tempprefix, gone):          false,
+		fmt.Sprintf("%s%d", tempprefix, gone):               false,
+		fmt.Sprintf("%sx%d-123456", tempprefix, gone):       false,
+		tempprefix + "notes.txt":                            false,
+		"report.txt":                                        false,
+	} {
+		if got := orphanedtemp(name); got != want {
+			t.Errorf("orphanedtemp(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCheckTempPrefix(t *testing.T) {
+	for prefix, ok := range map[string]bool{
+		".zir-tmp-": true,
+		"tmp_":      true,
+		".zir.":     true,
+		"":          false,
+		"t-":        false,
+		".zirtmp":   false,
+		"a/b-tmp-":  false,
+	} {
+		if err := checktempprefix(prefix); (err == nil) != ok {
+			t.Errorf("checktempprefix(%q) = %v", prefix, err)
+		}
+	}
+}
+
+// A copy that is all holes uses no blocks at all, there's nothing to wait for
+func TestSettledStatHoles(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "holes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(16 << 20); err != nil {
+		t.Fatal(err)
+	}
+	began := time.Now()
+	sysstat, err := settledstat(f, 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sysstat.Blocks != 0 {
+		t.Skipf("The filesystem allocated %v blocks for holes", sysstat.Blocks)
+	}
+	if took := time.Since(began); took > time.Second {
+		t.Errorf("Waited %v for a file without blocks", took)
+	}
+}
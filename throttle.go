@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workergate lets at most limit workers process a file at the same time,
+// the limit can be changed while they run
+type workergate struct {
+	sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newworkergate(limit int) *workergate {
+	g := &workergate{limit: limit}
+	g.cond = sync.NewCond(&g.Mutex)
+	return g
+}
+
+// enter waits until the worker may process a file, a nil gate lets everyone through
+func (g *workergate) enter() {
+	if g == nil {
+		return
+	}
+	g.Lock()
+	for g.active >= g.limit {
+		g.cond.Wait()
+	}
+	g.active++
+	g.Unlock()
+}
+
+func (g *workergate) leave() {
+	if g == nil {
+		return
+	}
+	g.Lock()
+	g.active--
+	g.Unlock()
+	g.cond.Signal()
+}
+
+func (g *workergate) setlimit(limit int) {
+	g.Lock()
+	g.limit = max(1, limit)
+	g.Unlock()
+	g.cond.Broadcast()
+}
+
+func (g *workergate) getlimit() int {
+	g.Lock()
+	defer g.Unlock()
+	return g.limit
+}
+
+// poolload is what zpool iostat saw over one interval
+type poolload struct {
+	ops  uint64        // reads and writes per second
+	wait time.Duration // average time an IO took, the worst of reads and writes
+}
+
+// samplepoolload runs zpool iostat for one interval, which takes that long
+func samplepoolload(pool string, interval time.Duration) (poolload, error) {
+	seconds := strconv.Itoa(max(1, int(interval.Seconds())))
+	lines, err := zpool("iostat", "-Hpyl", pool, seconds, "1")
+	if err != nil {
+		return poolload{}, err
+	}
+	if len(lines) != 1 {
+		return poolload{}, fmt.Errorf("unexpected zpool iostat output %q", lines)
+	}
+	// name, alloc, free, read and write ops, read and write bandwidth, read and write total wait, ...
+	fields := strings.Fields(lines[0])
+	if len(fields) < 9 {
+		return poolload{}, fmt.Errorf("unexpected zpool iostat output %q", lines[0])
+	}
+	number := func(field string) uint64 {
+		// Missing values are shown as -
+		n, _ := strconv.ParseUint(field, 10, 64)
+		return n
+	}
+	return poolload{
+		ops:  number(fields[3]) + number(fields[4]),
+		wait: time.Duration(max(number(fields[7]), number(fields[8]))),
+	}, nil
+}
+
+// busy tells if the load is over the --throttle thresholds, or under
+// three quarters of them so there is room for more
+func (pl poolload) busy() (over, under bool) {
+	over = (*throttlelatency > 0 && pl.wait > *throttlelatency) || (*throttleops > 0 && pl.ops > uint64(*throttleops))
+	under = (*throttlelatency == 0 || pl.wait < *throttlelatency*3/4) && (*throttleops == 0 || pl.ops < uint64(*throttleops)*3/4)
+	return over, under
+}
+
+// startthrottle watches the load of the pool root is on with --throttle, halving
+// the number of busy workers when it is over the thresholds and adding one
+// back every interval it is well under them. Call stop when done.
+func startthrottle(root string) (g *workergate, stop func()) {
+	name, err := datasetforpath(root)
+	if err != nil {
+		logerror("Not throttling, can't find the pool for %s: %v", root, err)
+		return nil, func() {}
+	}
+	pool := poolname(name)
+	g = newworkergate(int(*threads))
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			load, err := samplepoolload(pool, *throttleinterval)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err != nil {
+				logerror("Not throttling anymore, failed to get the load of pool %s: %v", pool, err)
+				g.setlimit(int(*threads))
+				return
+			}
+			limit := g.getlimit()
+			switch over, under := load.busy(); {
+			case over && limit > 1:
+				g.setlimit(limit / 2)
+				log("Pool %s is busy (%v ops/s, IO taking %v), going down to %v threads", pool, load.ops, load.wait, g.getlimit())
+			case under && limit < int(*threads):
+				g.setlimit(limit + 1)
+				debug("Pool %s has room (%v ops/s, IO taking %v), going up to %v threads", pool, load.ops, load.wait, limit+1)
+			}
+		}
+	}()
+	return g, func() {
+		close(done)
+	}
+}
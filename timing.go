@@ -0,0 +1,24 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Time spent in each phase, summed over all threads
+var walktime, copytime, dbtime atomic.Int64
+
+// timed adds the time since start to the counter, use as defer timed(&counter, time.Now())
+func timed(counter *atomic.Int64, start time.Time) {
+	counter.Add(int64(time.Since(start)))
+}
+
+func logtiming() {
+	log("Time spent walking directories %v, and summed over all threads reading and writing files %v, in the resume database %v",
+		time.Duration(walktime.Load()).Round(time.Millisecond),
+		time.Duration(copytime.Load()).Round(time.Millisecond),
+		time.Duration(dbtime.Load()).Round(time.Millisecond))
+	if *prefetch > 0 {
+		log("Time spent prefetching %v", time.Duration(prefetchtime.Load()).Round(time.Millisecond))
+	}
+}
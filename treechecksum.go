@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+var treechecksum *bool
+
+// treefile is a file the run rewrote, with the checksum of what was read from it to do so
+type treefile struct {
+	fp       string // as the walk found it
+	readback string // where the new contents are, different with --mirror-to
+	hash     []byte
+}
+
+var treefiles struct {
+	sync.Mutex
+	files []treefile
+}
+
+func addtreefile(fp, readback string, hash []byte) {
+	treefiles.Lock()
+	treefiles.files = append(treefiles.files, treefile{fp, readback, hash})
+	treefiles.Unlock()
+}
+
+// treesum is the checksum of the paths and checksums of all the files, in path order
+// so it's the same whatever order the threads got to them in
+func treesum(files []treefile) []byte {
+	h := sha256.New()
+	for _, f := range files {
+		io.WriteString(h, f.fp)
+		h.Write([]byte{0})
+		h.Write(f.hash)
+	}
+	return h.Sum(nil)
+}
+
+// checktree reads all the files the run rewrote back for --tree-checksum, and
+// compares the checksum over all of them with the one of what was read before they
+// were rewritten. Contents that ended up in another file show up too.
+func checktree() error {
+	treefiles.Lock()
+	files := treefiles.files
+	treefiles.Unlock()
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].fp < files[j].fp
+	})
+
+	log("Reading %v rewritten files back for the tree checksum", len(files))
+	after := make([]treefile, len(files))
+	queue := make(chan int, *queuesize)
+	var readers sync.WaitGroup
+	for i := 0; i < int(*threads); i++ {
+		readers.Add(1)
+		go func() {
+			buffer := recordbuffer(*buffersize)
+			for i := range queue {
+				after[i] = files[i]
+				hash, err := hashfile(files[i].readback, buffer)
+				if err != nil {
+					logerror("Could not read %s back for the tree checksum: %v", files[i].readback, err)
+				}
+				after[i].hash = hash
+			}
+			readers.Done()
+		}()
+	}
+	for i := range files {
+		if abort.Load() {
+			break
+		}
+		queue <- i
+	}
+	close(queue)
+	readers.Wait()
+	if abort.Load() {
+		return fmt.Errorf("Aborted due to interrupt, the tree checksum was not checked")
+	}
+
+	before, now := treesum(files), treesum(after)
+	log("Tree checksum of the %v rewritten files before: %x", len(files), before)
+	log("Tree checksum of the %v rewritten files after:  %x", len(files), now)
+	if bytes.Equal(before, now) {
+		return nil
+	}
+	var changed int
+	for i := range files {
+		if !bytes.Equal(files[i].hash, after[i].hash) {
+			logerror("Contents of %s are not what was read from %s before rewriting it", files[i].readback, files[i].fp)
+			changed++
+		}
+	}
+	return fmt.Errorf("The tree checksum doesn't match, %v files have other contents than before", changed)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// rewrittenfiles remembers what was written during a run, for --verify-dataset
+type rewrittenfiles struct {
+	sync.Mutex
+	paths []string
+}
+
+func (rf *rewrittenfiles) add(fp string) {
+	rf.Lock()
+	rf.paths = append(rf.paths, fp)
+	rf.Unlock()
+}
+
+// verifyfiles reads every file back fully, and returns how many of them failed.
+// It's no scrub, but it catches files that can't be read anymore after the rewrite.
+func verifyfiles(paths []string) int {
+	log("Verifying %v rewritten files can be read back", len(paths))
+	return readbackall(func(queue chan<- string) {
+		for _, fp := range paths {
+			if abort.Load() {
+				return
+			}
+			queue <- fp
+		}
+	})
+}
+
+// verifytree reads back all the files below the roots, for the verify command
+func verifytree(roots []string) int {
+	log("Verifying all files can be read back")
+	var walkfailed int
+	failed := readbackall(func(queue chan<- string) {
+		for _, root := range roots {
+			var rootdev uint64
+			if rootinfo, err := os.Stat(root); err == nil {
+				rootdev = uint64(rootinfo.Sys().(*syscall.Stat_t).Dev)
+			}
+			filepath.WalkDir(root, func(fp string, di os.DirEntry, err error) error {
+				if abort.Load() {
+					return filepath.SkipAll
+				}
+				if err != nil {
+					logerror("Error walking %s, skipping it: %v", fp, err)
+					walkfailed++
+					return nil
+				}
+				if *onefilesystem && di.IsDir() && fp != root {
+					fileinfo, err := di.Info()
+					if err == nil && uint64(fileinfo.Sys().(*syscall.Stat_t).Dev) != rootdev {
+						return filepath.SkipDir
+					}
+				}
+				if fp != root && pseudofsdir(fp, di, rootdev) != "" {
+					return filepath.SkipDir
+				}
+				if strings.HasPrefix(di.Name(), resumedbname) {
+					if di.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if len(excludes) > 0 && fp != root {
+					rel, _ := filepath.Rel(root, fp)
+					if excluded(rel, di.IsDir()) != "" {
+						if di.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+				}
+				if pattern, _ := walkignorefiles(fp, di.IsDir()); pattern != "" {
+					if di.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if di.Type().IsRegular() && !strings.HasPrefix(di.Name(), tempprefix) {
+					queue <- fp
+				}
+				return nil
+			})
+		}
+	})
+	return failed + walkfailed
+}
+
+// readbackall reads back the files feed puts in the queue with --threads readers,
+// and returns how many of them failed
+func readbackall(feed func(queue chan<- string)) int {
+	var failed int
+	var lock sync.Mutex
+	queue := make(chan string, *queuesize)
+	var readers sync.WaitGroup
+	for i := 0; i < int(*threads); i++ {
+		readers.Add(1)
+		go func() {
+			buffer := recordbuffer(*buffersize)
+			for fp := range queue {
+				if err := readback(fp, buffer); err != nil {
+					logerror("Verify failed for %s: %v", fp, err)
+					lock.Lock()
+					failed++
+					lock.Unlock()
+				}
+			}
+			readers.Done()
+		}()
+	}
+	feed(queue)
+	close(queue)
+	readers.Wait()
+	return failed
+}
+
+func readback(fp string, buffer []byte) error {
+	f, err := opensource(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = copyrecords(io.Discard, f, buffer)
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type walkdir struct {
+	fp string
+	di fs.DirEntry
+}
+
+// parallelwalker reads several directories at once, and calls fn for every
+// entry found. Directories waiting to be read are kept in a stack instead of
+// a goroutine each, so wide trees don't blow up memory.
+type parallelwalker struct {
+	fn fs.WalkDirFunc
+
+	lock    sync.Mutex
+	wake    *sync.Cond
+	queue   []walkdir
+	pending int // directories queued or being read
+	done    bool
+	err     error
+}
+
+// parallelwalk works like filepath.WalkDir, except that up to threads
+// directories are read concurrently. fn is called from several goroutines at
+// the same time, and entries arrive in no particular order - but a directory
+// is always passed to fn before anything inside it.
+func parallelwalk(root string, threads int, fn fs.WalkDirFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fn(root, fs.FileInfoToDirEntry(info), nil)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	if err != nil || !info.IsDir() {
+		return err
+	}
+
+	pw := &parallelwalker{
+		fn:      fn,
+		queue:   []walkdir{{root, fs.FileInfoToDirEntry(info)}},
+		pending: 1,
+	}
+	pw.wake = sync.NewCond(&pw.lock)
+
+	var walkers sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		walkers.Add(1)
+		go func() {
+			pw.walker()
+			walkers.Done()
+		}()
+	}
+	walkers.Wait()
+
+	return pw.err
+}
+
+func (pw *parallelwalker) walker() {
+	for {
+		pw.lock.Lock()
+		for len(pw.queue) == 0 && pw.pending > 0 && !pw.done {
+			pw.wake.Wait()
+		}
+		if pw.pending == 0 || pw.done {
+			pw.lock.Unlock()
+			pw.wake.Broadcast()
+			return
+		}
+		// Take the newest directory, which keeps the stack shallow
+		dir := pw.queue[len(pw.queue)-1]
+		pw.queue = pw.queue[:len(pw.queue)-1]
+		pw.lock.Unlock()
+
+		subdirs, err := walkreaddir(dir, false, pw.fn)
+
+		pw.lock.Lock()
+		if err == filepath.SkipAll {
+			pw.done = true
+		} else if err != nil && pw.err == nil {
+			pw.err = err
+			pw.done = true
+		}
+		pw.queue = append(pw.queue, subdirs...)
+		pw.pending += len(subdirs) - 1
+		pw.lock.Unlock()
+		pw.wake.Broadcast()
+	}
+}
+
+// walkreaddir calls fn for every entry in dir, sorted by name like WalkDir if asked,
+// and returns the subdirectories to descend into
+func walkreaddir(dir walkdir, sorted bool, fn fs.WalkDirFunc) ([]walkdir, error) {
+	var entries []fs.DirEntry
+	f, err := os.Open(dir.fp)
+	if err == nil {
+		entries, err = f.ReadDir(-1)
+		f.Close()
+	}
+	if sorted {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}
+	if err != nil {
+		// Same as WalkDir, report the error and carry on with whatever we got
+		err = fn(dir.fp, dir.di, err)
+		if err == filepath.SkipDir {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var subdirs []walkdir
+	for _, di := range entries {
+		fp := filepath.Join(dir.fp, di.Name())
+		err := fn(fp, di, nil)
+		if err == filepath.SkipDir {
+			if di.IsDir() {
+				continue
+			}
+			// Skip the rest of this directory
+			break
+		}
+		if err != nil {
+			return subdirs, err
+		}
+		if di.IsDir() {
+			subdirs = append(subdirs, walkdir{fp, di})
+		}
+	}
+	return subdirs, nil
+}
+
+// orderedwalk works like filepath.WalkDir, but passes all entries of a directory to
+// fn before going into any of its subdirectories, so the files of one directory are
+// done together. depth-first then finishes each subdirectory before the next one,
+// breadth-first does all directories of one level before going a level deeper.
+func orderedwalk(root string, breadthfirst bool, fn fs.WalkDirFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fn(root, fs.FileInfoToDirEntry(info), nil)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	if err != nil || !info.IsDir() {
+		return err
+	}
+
+	queue := []walkdir{{root, fs.FileInfoToDirEntry(info)}}
+	for len(queue) > 0 {
+		var dir walkdir
+		if breadthfirst {
+			dir = queue[0]
+			queue = queue[1:]
+		} else {
+			dir = queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+		}
+		subdirs, err := walkreaddir(dir, true, fn)
+		if err == filepath.SkipAll {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !breadthfirst {
+			// The stack takes the last one first, keep them in lexical order
+			slices.Reverse(subdirs)
+		}
+		queue = append(queue, subdirs...)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// walktree makes a tree of empty files, width directories per level down to depth
+func walktree(tb testing.TB, dir string, width, depth, files int) {
+	tb.Helper()
+	for i := 0; i < files; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%03d", i)), nil, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if depth == 0 {
+		return
+	}
+	for i := 0; i < width; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir%02d", i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		walktree(tb, sub, width, depth-1, files)
+	}
+}
+
+// walked returns all paths the walk passes to fn, sorted
+func walked(tb testing.TB, walk func(fs.WalkDirFunc) error) []string {
+	tb.Helper()
+	var lock sync.Mutex
+	var paths []string
+	err := walk(func(fp string, di fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		paths = append(paths, fp)
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func TestParallelWalkSeesAll(t *testing.T) {
+	root := t.TempDir()
+	walktree(t, root, 4, 3, 5)
+	want := walked(t, func(fn fs.WalkDirFunc) error { return filepath.WalkDir(root, fn) })
+	for _, threads := range []int{1, 4, 16} {
+		got := walked(t, func(fn fs.WalkDirFunc) error { return parallelwalk(root, threads, fn) })
+		if !slices.Equal(got, want) {
+			t.Errorf("parallelwalk with %v threads found %v entries, WalkDir %v", threads, len(got), len(want))
+		}
+	}
+}
+
+// BenchmarkWalk compares parallelwalk with filepath.WalkDir on a tree of
+// 1111 directories and 11110 files. It's all in the page cache after the
+// first round, so this shows the overhead more than what waiting on disks gains.
+func BenchmarkWalk(b *testing.B) {
+	root := b.TempDir()
+	walktree(b, root, 10, 3, 10)
+	visit := func(fp string, di fs.DirEntry, err error) error {
+		return err
+	}
+	b.Run("WalkDir", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := filepath.WalkDir(root, visit); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, threads := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("parallelwalk/threads=%d", threads), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := parallelwalk(root, threads, visit); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+)
+
+// copyxattrs gives to the extended attributes of from, which includes POSIX ACLs
+func copyxattrs(from, to string) error {
+	size, err := syscall.Listxattr(from, nil)
+	if errors.Is(err, syscall.ENOTSUP) || size == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(from, list); err != nil {
+		return err
+	}
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := syscall.Getxattr(from, string(name), nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(from, string(name), value); err != nil {
+			return err
+		}
+		if err = syscall.Setxattr(to, string(name), value[:size], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
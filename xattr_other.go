@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Not available on this platform
+func copyxattrs(from, to string) error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var zdbcheck *bool
+
+// What --zdb-check compares the blocks of files against, set for each root by setupzdb.
+// An empty dataset means the ratio check decides.
+var zdbtarget struct {
+	dataset   string
+	dev       uint64
+	algorithm string // as zdb names it in block pointers
+}
+
+// zdbalgorithm turns the compression property into the name zdb shows in block pointers,
+// which has no levels for zstd
+func zdbalgorithm(compression string) string {
+	switch {
+	case compression == "on":
+		return "lz4"
+	case compression == "gzip":
+		return "gzip-6"
+	case strings.HasPrefix(compression, "zstd"):
+		return "zstd"
+	}
+	return compression
+}
+
+// Compression names zdb prints in block pointers, besides these there are only checksums and flags
+var zdbcompressions = map[string]bool{"uncompressed": true, "lzjb": true, "empty": true, "zle": true, "lz4": true, "zstd": true,
+	"gzip-1": true, "gzip-2": true, "gzip-3": true, "gzip-4": true, "gzip-5": true, "gzip-6": true, "gzip-7": true, "gzip-8": true, "gzip-9": true}
+
+// setupzdb finds the dataset and algorithm for --zdb-check below root
+func setupzdb(root string, rootdev uint64) {
+	zdbtarget.dataset = ""
+	if !*zdbcheck || !toolavailable("zdb") {
+		return
+	}
+	name, err := datasetforpath(root)
+	if err != nil {
+		log("Not using zdb for %s, going by the compression ratio: %v", root, err)
+		return
+	}
+	compression, err := zfsget(name, "compression")
+	if err != nil {
+		log("Not using zdb for %s, going by the compression ratio: %v", root, err)
+		return
+	}
+	zdbtarget.dataset, zdbtarget.dev, zdbtarget.algorithm = name, rootdev, zdbalgorithm(compression)
+	debug("Checking with zdb which files in dataset %s have blocks not stored with %s", name, zdbtarget.algorithm)
+}
+
+// blockcompressions counts the data blocks of an object per compression algorithm, as zdb
+// shows them with full block pointers. Holes and data embedded in the pointer don't count.
+func blockcompressions(dataset string, object uint64) (map[string]int, error) {
+	lines, err := runlines("zdb", "-ddddd", "-bbbbbb", dataset, strconv.FormatUint(object, 10))
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "L0" || strings.Contains(line, "EMBEDDED") || strings.Contains(line, "HOLE") {
+			continue
+		}
+		for _, field := range fields[2:] {
+			if zdbcompressions[field] {
+				counts[field]++
+				break
+			}
+		}
+	}
+	return counts, nil
+}
+
+// What zdb says about a file
+type zdbverdict int
+
+const (
+	zdbunknown zdbverdict = iota // zdb can't tell, the ratio check decides
+	zdbdone                      // every compressed block already uses the dataset's algorithm
+	zdbdue                       // some blocks use another algorithm
+)
+
+// zdbcheckfile looks at the blocks of the file with zdb. Uncompressed blocks say nothing,
+// they are either data that doesn't compress or written with compression off, so a file
+// with only those is left to the ratio check.
+func zdbcheckfile(fp string, sysstat *syscall.Stat_t) (zdbverdict, string) {
+	if zdbtarget.dataset == "" || uint64(sysstat.Dev) != zdbtarget.dev {
+		return zdbunknown, ""
+	}
+	counts, err := blockcompressions(zdbtarget.dataset, sysstat.Ino)
+	if err != nil {
+		if strings.Contains(err.Error(), "ermission") {
+			toolmissing("zdb", fmt.Sprintf("zdb is not allowed to read the pool (%v)", err))
+		} else {
+			debug("Could not check %s with zdb: %v", fp, err)
+		}
+		return zdbunknown, ""
+	}
+	var target, other int
+	var others []string
+	for algorithm, n := range counts {
+		switch algorithm {
+		case zdbtarget.algorithm:
+			target += n
+		case "uncompressed", "empty":
+		default:
+			other += n
+			others = append(others, fmt.Sprintf("%v blocks with %s", n, algorithm))
+		}
+	}
+	switch {
+	case other > 0:
+		return zdbdue, fmt.Sprintf("%s, not %s", strings.Join(others, ", "), zdbtarget.algorithm)
+	case target > 0:
+		return zdbdone, fmt.Sprintf("%v blocks with %s and %v uncompressed", target, zdbtarget.algorithm, counts["uncompressed"])
+	}
+	return zdbunknown, ""
+}
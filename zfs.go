@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dataset struct {
+	name        string
+	mountpoint  string
+	compression string
+	readonly    string
+	mounted     string
+}
+
+// errnotools means the zfs or zpool command can't be used here, so what needs it is skipped
+var errnotools = errors.New("is not available")
+
+// What the features asking each command fall back to, for the warning when it's missing
+var toolfallbacks = map[string]string{
+	"zfs":   "going by file sizes and blocks only, dataset properties like recordsize and " + propertyprefix + "*, the dedup check, compression ratio reports and --all-datasets are off",
+	"zpool": "going by file sizes and blocks only, the block cloning check, syncing the pool before reports and --throttle are off",
+	"zdb":   "--zdb-check is off, the compression ratio decides instead",
+}
+
+// The commands found to be unusable, all through the run, so each is only warned about once
+var missingtools = struct {
+	sync.Mutex
+	checked map[string]bool
+	missing map[string]bool
+}{checked: map[string]bool{}, missing: map[string]bool{}}
+
+// toolavailable tells if command can be run, looking for it in PATH on first use
+func toolavailable(command string) bool {
+	missingtools.Lock()
+	defer missingtools.Unlock()
+	if !missingtools.checked[command] {
+		missingtools.checked[command] = true
+		if _, err := exec.LookPath(command); err != nil {
+			missingtools.missing[command] = true
+			warnmissingtool(command, fmt.Sprintf("the %s command is not in PATH", command))
+		}
+	}
+	return !missingtools.missing[command]
+}
+
+// toolmissing stops using command, with a warning the first time
+func toolmissing(command, reason string) {
+	missingtools.Lock()
+	defer missingtools.Unlock()
+	if !missingtools.missing[command] {
+		missingtools.missing[command] = true
+		warnmissingtool(command, reason)
+	}
+}
+
+func warnmissingtool(command, reason string) {
+	log("Warning: %s: %s", reason, toolfallbacks[command])
+}
+
+// zfs runs the zfs command and returns the lines it printed
+func zfs(args ...string) ([]string, error) {
+	return runlines("zfs", args...)
+}
+
+func zpool(args ...string) ([]string, error) {
+	return runlines("zpool", args...)
+}
+
+// runlines is how all ZFS commands are run. When the command is missing or can't talk
+// to ZFS, as in a container without /dev/zfs, it fails with errnotools from then on.
+func runlines(command string, args ...string) ([]string, error) {
+	if !toolavailable(command) {
+		return nil, fmt.Errorf("%s command %w", command, errnotools)
+	}
+	output, err := exec.Command(command, args...).Output()
+	if err != nil {
+		var exiterr *exec.ExitError
+		if errors.As(err, &exiterr) && len(exiterr.Stderr) > 0 {
+			stderr := strings.TrimSpace(string(exiterr.Stderr))
+			if strings.Contains(stderr, "libzfs") || strings.Contains(stderr, "/dev/zfs") {
+				toolmissing(command, fmt.Sprintf("%s can't reach ZFS (%s)", command, stderr))
+				return nil, fmt.Errorf("%s command %w: %s", command, errnotools, stderr)
+			}
+			return nil, fmt.Errorf("%s %s: %s", command, strings.Join(args, " "), stderr)
+		}
+		return nil, err
+	}
+	trimmed := strings.TrimRight(string(output), "\n")
+	if trimmed == "" {
+		return nil, nil
+	}
+	return strings.Split(trimmed, "\n"), nil
+}
+
+// listdatasets returns all ZFS filesystems known to the system
+func listdatasets() ([]dataset, error) {
+	lines, err := zfs("list", "-H", "-t", "filesystem", "-o", "name,mountpoint,compression,readonly,mounted")
+	if err != nil {
+		return nil, err
+	}
+	var datasets []dataset
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected zfs list output %q", line)
+		}
+		datasets = append(datasets, dataset{
+			name:        fields[0],
+			mountpoint:  fields[1],
+			compression: fields[2],
+			readonly:    fields[3],
+			mounted:     fields[4],
+		})
+	}
+	return datasets, nil
+}
+
+// skipreason explains why the dataset should not be processed, or returns an empty string
+func (ds dataset) skipreason() string {
+	switch {
+	case ds.mounted != "yes":
+		return "it is not mounted"
+	case ds.mountpoint == "none" || ds.mountpoint == "legacy" || ds.mountpoint == "-":
+		return "it has no mountpoint we can use"
+	case ds.compression == "off":
+		return "compression is off"
+	case ds.readonly == "on":
+		return "it is read-only"
+	}
+	return ""
+}
+
+// zfsget returns a single property of a dataset, with numbers in exact form
+func zfsget(name, property string) (string, error) {
+	lines, err := zfs("get", "-Hp", "-o", "value", property, name)
+	if err != nil {
+		return "", err
+	}
+	if len(lines) != 1 {
+		return "", fmt.Errorf("unexpected zfs get output %q", lines)
+	}
+	return lines[0], nil
+}
+
+// datasetused returns the space used by the dataset in bytes
+func datasetused(name string) (uint64, error) {
+	value, err := zfsget(name, "used")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// datasetforpath returns the name of the dataset containing the path
+func datasetforpath(fp string) (string, error) {
+	abs, err := filepath.Abs(fp)
+	if err != nil {
+		return "", err
+	}
+	lines, err := zfs("list", "-H", "-o", "name", abs)
+	if err != nil {
+		return "", err
+	}
+	if len(lines) != 1 {
+		return "", fmt.Errorf("unexpected zfs list output %q", lines)
+	}
+	return lines[0], nil
+}
+
+// poolname returns the pool a dataset lives in
+func poolname(name string) string {
+	pool, _, _ := strings.Cut(name, "/")
+	return pool
+}
+
+// poolclonedbytes returns how much space block cloning saves in the pool, 0 on pools without it
+func poolclonedbytes(pool string) (uint64, error) {
+	lines, err := zpool("get", "-Hp", "-o", "value", "bcloneused", pool)
+	if err != nil {
+		return 0, err
+	}
+	if len(lines) != 1 || lines[0] == "-" {
+		return 0, nil
+	}
+	return strconv.ParseUint(lines[0], 10, 64)
+}
+
+// zpoolsync waits for pending writes to hit the pool, so space accounting is up to date
+func zpoolsync(pool string) {
+	if _, err := zpool("sync", pool); err != nil {
+		debug("Syncing pool %s failed: %v", pool, err)
+	}
+}
+
+// watchcompression checks the compression property of the dataset every
+// --compression-property-check-interval while it is processed, and stops
+// processing it if compression is turned off. Call stop when done.
+func watchcompression(name, compression string) (stop func()) {
+	if *compressioncheckinterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var watcher sync.WaitGroup
+	watcher.Add(1)
+	go func() {
+		defer watcher.Done()
+		ticker := time.NewTicker(*compressioncheckinterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			current, err := zfsget(name, "compression")
+			if err != nil {
+				logerror("Failed to check the compression of dataset %s: %v", name, err)
+				continue
+			}
+			if current == compression {
+				continue
+			}
+			log("Compression of dataset %s was changed from %s to %s", name, compression, current)
+			compression = current
+			if current == "off" {
+				compressionoff.Store(true)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		watcher.Wait()
+	}
+}